@@ -7,10 +7,13 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
+	_ "time/tzdata" // Embed time zones for access windows.
 
 	"github.com/aurora-is-near/sshaclsrv/cmd/aclmodel/server"
 
 	"github.com/aurora-is-near/sshaclsrv/src/model"
+
+	"golang.org/x/crypto/ssh"
 )
 
 // Config contains the configuration necessary for operation.
@@ -19,6 +22,7 @@ var Config = &model.Persistence{
 	UserDir:   "/path/to/users",
 	BaseDir:   "/path/to/basedir",
 	KeyFile:   "/path/to/signKeyfile",
+	CAKeyFile: "/path/to/ca_key",
 }
 
 const (
@@ -29,6 +33,12 @@ var (
 	updateFile  string
 	compileFile string
 	configGen   string
+	certFile    string
+	revokeFile  string
+	certUser    string
+	certKey     string
+	certSysUser string
+	certServer  string
 	listen      bool
 	port        uint
 )
@@ -37,6 +47,12 @@ func init() {
 	flag.StringVar(&updateFile, "update", defaultString, "update model")
 	flag.StringVar(&compileFile, "compile", defaultString, "compile model")
 	flag.StringVar(&configGen, "mkconfig", defaultString, "generate configfile")
+	flag.StringVar(&certFile, "certificate", defaultString, "issue user certificate")
+	flag.StringVar(&revokeFile, "revoke", defaultString, "publish revocation list")
+	flag.StringVar(&certUser, "user", "", "user to issue certificate for")
+	flag.StringVar(&certKey, "fingerprint", "", "fingerprint of the key to certify")
+	flag.StringVar(&certSysUser, "systemusers", "", "comma separated system users whose grants set the certificate validity and options")
+	flag.StringVar(&certServer, "server", "", "server whose grants set the certificate validity and options")
 	flag.BoolVar(&listen, "s", false, "serve via http. For debugging")
 	flag.UintVar(&port, "p", 9103, "listen on 127.0.0.1:<port>")
 }
@@ -56,6 +72,33 @@ func exampleConfig() error {
 	return nil
 }
 
+func countSet(s ...string) int {
+	var n int
+	for _, e := range s {
+		if !flagEmpty(e) {
+			n++
+		}
+	}
+	return n
+}
+
+// issueCertificate writes a certificate for the key given on the command line to stdout.
+func issueCertificate() error {
+	var systemUsers []model.SystemUserName
+	for _, systemUser := range strings.Split(certSysUser, ",") {
+		if systemUser = strings.TrimSpace(systemUser); systemUser != "" {
+			systemUsers = append(systemUsers, model.SystemUserName(systemUser))
+		}
+	}
+	fingerprint := strings.TrimPrefix(certKey, "SHA256:")
+	cert, err := Config.IssueCertificate(model.UserName(certUser), fingerprint, model.ServerName(certServer), systemUsers...)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(ssh.MarshalAuthorizedKey(cert))
+	return err
+}
+
 func readConfig(filename string) error {
 	d, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -71,12 +114,16 @@ func main() {
 	var err error
 	var warnings []string
 	flag.Parse()
-	if (!flagEmpty(updateFile) && !flagEmpty(compileFile)) || (!flagEmpty(updateFile) && !flagEmpty(configGen)) || (!flagEmpty(compileFile) && !flagEmpty(configGen)) {
-		_, _ = fmt.Fprintf(os.Stderr, "Cannot use more than one of --update, --compile, or --mkconfig.\n\n")
+	if modes := countSet(updateFile, compileFile, configGen, certFile, revokeFile); modes > 1 {
+		_, _ = fmt.Fprintf(os.Stderr, "Cannot use more than one of --update, --compile, --mkconfig, --certificate, or --revoke.\n\n")
 		os.Exit(1)
 	}
-	if listen && !flagEmpty(configGen) {
-		_, _ = fmt.Fprintf(os.Stderr, "Listen cannot be used with --mkconfig.\n\n")
+	if !flagEmpty(certFile) && (certUser == "" || certKey == "" || certServer == "") {
+		_, _ = fmt.Fprintf(os.Stderr, "--certificate requires --user, --fingerprint and --server.\n\n")
+		os.Exit(1)
+	}
+	if listen && (!flagEmpty(configGen) || !flagEmpty(certFile)) {
+		_, _ = fmt.Fprintf(os.Stderr, "Listen cannot be used with --mkconfig or --certificate.\n\n")
 		os.Exit(1)
 	}
 	if listen && port < 1024 {
@@ -94,6 +141,14 @@ func main() {
 		if err = readConfig(compileFile); err == nil {
 			warnings, err = Config.CompileAndStore()
 		}
+	case !flagEmpty(certFile):
+		if err = readConfig(certFile); err == nil {
+			err = issueCertificate()
+		}
+	case !flagEmpty(revokeFile):
+		if err = readConfig(revokeFile); err == nil {
+			warnings, err = Config.PublishRevocations()
+		}
 	}
 	if len(warnings) > 0 {
 		_, _ = fmt.Fprintf(os.Stderr, "%s\n\n", strings.Join(warnings, "\n"))
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"os"
+	"time"
+
+	"github.com/aurora-is-near/sshaclsrv/src/gosshacl"
+)
+
+const (
+	auditSyslog = "syslog"
+)
+
+// auditRecord is written for every lookup.
+type auditRecord struct {
+	Time        time.Time
+	User        string
+	Fingerprint string `json:",omitempty"`
+	KeyID       string `json:",omitempty"` // Certificate key ID of principal lookups.
+	Hostname    string
+	Client      string      `json:",omitempty"` // Client address, if known.
+	Backend     string      `json:",omitempty"`
+	Source      string      `json:",omitempty"`
+	Keys        int         // Number of keys returned.
+	NotAfter    []time.Time `json:",omitempty"` // Expiry of matched entries, zero for no expiry.
+	Signers     []string    `json:",omitempty"` // Delegated keys that signed matched entries.
+	Sources     []string    `json:",omitempty"` // Files that contained matched entries.
+	Windows     []string    `json:",omitempty"` // Access windows of matched entries.
+	Revocations uint64      `json:",omitempty"` // Serial of the revocation list in effect.
+	Error       string      `json:",omitempty"`
+}
+
+func newAuditRecord(q *gosshacl.Query, err error) *auditRecord {
+	record := &auditRecord{
+		Time:        time.Now().UTC(),
+		User:        q.User,
+		Fingerprint: q.Fingerprint,
+		Hostname:    config.Hostname,
+	}
+	if q.ClientAddress != nil {
+		record.Client = q.ClientAddress.String()
+	}
+	if q.Revocations != nil {
+		record.Revocations = q.Revocations.Serial
+	}
+	if q.KeyID != "" {
+		record.Fingerprint, record.KeyID = "", q.KeyID
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	if q.Result == nil {
+		return record
+	}
+	record.Backend = q.Result.Backend
+	record.Source = q.Result.Source
+	record.Keys = len(q.Result.Matches)
+	for _, m := range q.Result.Matches {
+		record.NotAfter = append(record.NotAfter, m.NotAfter)
+		if m.Source != "" {
+			record.Sources = append(record.Sources, m.Source)
+		}
+		record.Windows = append(record.Windows, m.Windows...)
+		if m.Signer != nil {
+			record.Signers = append(record.Signers, base64.StdEncoding.EncodeToString(m.Signer))
+		}
+	}
+	return record
+}
+
+func writeAuditRecord(destination string, record *auditRecord) error {
+	d, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if destination == auditSyslog {
+		w, err := syslog.New(syslog.LOG_AUTH|syslog.LOG_INFO, "sshaclsrv")
+		if err != nil {
+			return err
+		}
+		defer func() { _ = w.Close() }()
+		return w.Info(string(d))
+	}
+	f, err := os.OpenFile(destination, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(d, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// audit writes an audit record for the query, if configured. Failures are reported but never change the result of
+// the lookup.
+func audit(q *gosshacl.Query, err error) {
+	if config.AuditLog == "" {
+		return
+	}
+	if err := writeAuditRecord(config.AuditLog, newAuditRecord(q, err)); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "cannot write audit record: %s\n", err)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/aurora-is-near/sshaclsrv/src/gosshacl"
+)
+
+// check reports problems in the keyfile and exits non-zero if there are any. The keyfile defaults to the one
+// configured and its fragments. The configuration may be missing if a keyfile is given.
+func check(args []string) {
+	if len(args) > 1 {
+		usage()
+	}
+	configSet := false
+	flag.Visit(func(f *flag.Flag) { configSet = configSet || f.Name == "c" })
+	if err := readConfig(configFile); err != nil && (configSet || len(args) == 0 || !os.IsNotExist(err)) {
+		_, _ = fmt.Fprintf(os.Stderr, "error reading configfile: %s\n", err)
+		os.Exit(1)
+	}
+	var publicKey ed25519.PublicKey
+	if config.SignedKeyFile {
+		publicKey = config.PublicKey
+	}
+	files := args
+	if len(files) == 0 {
+		files = []string{config.KeyFile}
+		if config.KeyDir != "" {
+			fragments, err := gosshacl.Fragments(config.KeyDir)
+			if err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "%s: %s\n", config.KeyDir, err)
+				os.Exit(2)
+			}
+			files = append(files, fragments...)
+		}
+	}
+	var problems int
+	for _, filename := range files {
+		n, err := checkFile(filename, publicKey)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s: %s\n", filename, err)
+			os.Exit(2)
+		}
+		problems += n
+	}
+	if problems > 0 {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// checkFile prints the problems found in filename and returns their number.
+func checkFile(filename string, publicKey ed25519.PublicKey) (int, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+	diagnostics, err := gosshacl.Check(f, publicKey)
+	for _, d := range diagnostics {
+		_, _ = fmt.Fprintf(os.Stdout, "%s:%s\n", filename, d)
+	}
+	return len(diagnostics), err
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aurora-is-near/sshaclsrv/src/manifest"
+
+	"github.com/aurora-is-near/sshaclsrv/src/fileperm"
+
+	"github.com/aurora-is-near/sshaclsrv/src/util"
+
+	"github.com/aurora-is-near/sshaclsrv/src/gosshacl"
+)
+
+var (
+	// errEmptyDownload is returned if a download does not contain any verified entry.
+	errEmptyDownload = errors.New("download contains no verified entries")
+)
+
+// message returns the signed message of a line if the keyfile keeps signatures, or the line itself.
+func message(line []byte) []byte {
+	if !config.SignedKeyFile {
+		return line
+	}
+	if p := bytes.IndexByte(line, ':'); p >= 0 {
+		return line[p+1:]
+	}
+	return nil
+}
+
+// countEntries returns the number of lines in d that are neither empty nor comments.
+func countEntries(d []byte) int {
+	var n int
+	for _, line := range bytes.Split(d, []byte{'\n'}) {
+		line = bytes.TrimSpace(message(bytes.TrimSpace(line)))
+		if len(line) > 0 && line[0] != '#' {
+			n++
+		}
+	}
+	return n
+}
+
+func serialFile() string {
+	if config.SerialFile != "" {
+		return config.SerialFile
+	}
+	return config.KeyFile + ".serial"
+}
+
+// readSerial returns the highest manifest serial accepted so far, or zero.
+func readSerial() (uint64, error) {
+	f, err := os.Open(serialFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+	if err := fileperm.PermissionCheck(f); err != nil {
+		return 0, fmt.Errorf("%s: %s", serialFile(), err)
+	}
+	d, err := ioutil.ReadAll(f)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(d)), 10, 64)
+}
+
+func writeSerial(serial uint64) error {
+	tmpFile := fmt.Sprintf("%s.tmp-%d", serialFile(), time.Now().Unix())
+	_ = os.Remove(tmpFile)
+	if err := util.WriteFile(tmpFile, "%d\n", serial); err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmpFile) }()
+	return os.Rename(tmpFile, serialFile())
+}
+
+// findManifest returns the manifest contained in a verified download, or nil.
+func findManifest(d []byte) *manifest.Manifest {
+	for _, line := range bytes.Split(d, []byte{'\n'}) {
+		if line = message(line); manifest.IsManifest(line) {
+			m, _ := manifest.Parse(line)
+			return m
+		}
+	}
+	return nil
+}
+
+// fetchKeyfile downloads the keys for this host and replaces the keyfile with them, unless the content is unchanged.
+// The replaced keyfile is kept as rollover generation.
+// The revocation list is updated first, even while the keyfile is held, and lines it revokes are left out of the
+// keyfile.
+// It never replaces the keyfile with a download that does not contain any verified entry, or that is older or less
+// complete than its manifest and the last accepted serial allow.
+func fetchKeyfile(remotes *gosshacl.RemoteSet) (changed bool, entries int, err error) {
+	revocations, err := fetchRevocations(remotes)
+	if err != nil {
+		return false, 0, err
+	}
+	if isHeld() {
+		return false, 0, errHeld
+	}
+	minSerial, err := readSerial()
+	if err != nil {
+		return false, 0, err
+	}
+	for _, remote := range remotes.Remotes {
+		remote.MinSerial = minSerial
+		remote.RequireManifest = config.RequireManifest
+		remote.Signed = config.SignedKeyFile
+		remote.Revocations = revocations
+	}
+	buf := new(bytes.Buffer)
+	if err := remotes.Fetch(buf); err != nil {
+		return false, 0, err
+	}
+	if entries = countEntries(buf.Bytes()); entries == 0 {
+		return false, 0, errEmptyDownload
+	}
+	if m := findManifest(buf.Bytes()); m != nil && m.Serial > minSerial {
+		defer func() {
+			if err == nil {
+				err = writeSerial(m.Serial)
+			}
+		}()
+	}
+	if current, err := ioutil.ReadFile(config.KeyFile); err == nil && bytes.Equal(current, buf.Bytes()) {
+		return false, entries, updateIndex(false)
+	}
+	dlFile := fmt.Sprintf("%s.dl-%d", config.KeyFile, time.Now().Unix())
+	_ = os.Remove(dlFile)
+	if err := util.WriteFile(dlFile, "%s", buf.String()); err != nil {
+		return false, entries, err
+	}
+	defer func() { _ = os.Remove(dlFile) }()
+	if err := os.Chmod(dlFile, 0600); err != nil {
+		return false, entries, err
+	}
+	if err := permissionCheck(dlFile); err != nil {
+		return false, entries, fmt.Errorf("%s: %s", dlFile, err)
+	}
+	if err := keepGeneration(); err != nil {
+		return false, entries, err
+	}
+	if err := os.Rename(dlFile, config.KeyFile); err != nil {
+		return false, entries, err
+	}
+	return true, entries, updateIndex(true)
+}
+
+// updateIndex compiles the keyfile into its index if indexing is configured and the index is missing or stale.
+func updateIndex(changed bool) error {
+	if !config.IndexKeyFile {
+		return nil
+	}
+	if !changed {
+		if info, err := os.Stat(config.KeyFile); err == nil {
+			if index, err := gosshacl.OpenIndex(config.KeyFile+gosshacl.IndexExtension, info); err == nil {
+				index.Close()
+				return nil
+			}
+		}
+	}
+	return gosshacl.WriteIndex(config.KeyFile, config.SignedKeyFile)
+}
+
+func permissionCheck(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	return fileperm.PermissionCheck(f)
+}
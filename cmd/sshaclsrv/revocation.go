@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/aurora-is-near/sshaclsrv/src/revocation"
+
+	"github.com/aurora-is-near/sshaclsrv/src/gosshacl"
+)
+
+var (
+	// errRevocationRollback is returned if a fetched revocation list is older than the cached one.
+	errRevocationRollback = errors.New("revocation list older than cached serial")
+)
+
+func revocationFile() string {
+	if config.RevocationFile != "" {
+		return config.RevocationFile
+	}
+	return config.KeyFile + ".revoked"
+}
+
+// readRevocations returns the cached revocation list, or nil if there is none.
+func readRevocations() (*revocation.List, error) {
+	list, err := revocation.ReadFile(revocationFile(), config.PublicKey)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", revocationFile(), err)
+	}
+	return list, nil
+}
+
+// fetchRevocations downloads the revocation list and replaces the cached one with it, unless it is older. The cached
+// list is kept if the repositories do not publish one. It returns the list in effect, or nil if there is none.
+func fetchRevocations(remotes *gosshacl.RemoteSet) (*revocation.List, error) {
+	buf := new(bytes.Buffer)
+	switch err := remotes.FetchRevocations(buf); err {
+	case nil:
+	case gosshacl.ErrNotFound:
+		return readRevocations()
+	default:
+		return nil, err
+	}
+	list, err := revocation.Parse(buf.Bytes(), config.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	cached, err := readRevocations()
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil && list.Serial <= cached.Serial {
+		if list.Serial < cached.Serial {
+			return nil, errRevocationRollback
+		}
+		return cached, nil
+	}
+	f, err := ioutil.TempFile(path.Dir(revocationFile()), path.Base(revocationFile())+".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+	_, err = f.Write(buf.Bytes())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return list, os.Rename(f.Name(), revocationFile())
+}
+
+// setRevocations loads the cached revocation list into the query. A list that cannot be verified fails the lookup.
+func setRevocations(query *gosshacl.Query) {
+	list, err := readRevocations()
+	if err != nil {
+		audit(query, err)
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	query.Revocations = list
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aurora-is-near/sshaclsrv/src/constants"
+
+	"github.com/aurora-is-near/sshaclsrv/src/util"
+)
+
+var (
+	// errHeld is returned by fetches after a rollback, until the keyfile is promoted.
+	errHeld = errors.New("keyfile held after rollback, run 'rollover promote' to resume updates")
+	// errNoRollover is returned if there is no previous generation to roll back to.
+	errNoRollover = errors.New("no previous keyfile generation")
+)
+
+func rolloverFile() string {
+	return config.KeyFile + constants.RolloverExtension
+}
+
+func heldFile() string {
+	return config.KeyFile + ".held"
+}
+
+func isHeld() bool {
+	_, err := os.Stat(heldFile())
+	return err == nil
+}
+
+// keepGeneration makes the current keyfile the previous generation. It must be called before the keyfile is
+// replaced.
+func keepGeneration() error {
+	tmpFile := fmt.Sprintf("%s.tmp-%d", rolloverFile(), time.Now().UnixNano())
+	if err := os.Link(config.KeyFile, tmpFile); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer func() { _ = os.Remove(tmpFile) }()
+	return os.Rename(tmpFile, rolloverFile())
+}
+
+// promote accepts the current keyfile: the previous generation is removed and fetches resume.
+func promote() error {
+	if err := os.Remove(rolloverFile()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(heldFile()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// rollback replaces the keyfile with its previous generation and holds it until promoted.
+func rollback() error {
+	if _, err := os.Stat(rolloverFile()); err != nil {
+		if os.IsNotExist(err) {
+			return errNoRollover
+		}
+		return err
+	}
+	if !isHeld() {
+		if err := util.WriteFile(heldFile(), "%s\n", time.Now().UTC().Format(time.RFC3339)); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(rolloverFile(), config.KeyFile); err != nil {
+		return err
+	}
+	return updateIndex(true)
+}
+
+// rollover runs the rollover command given in args.
+func rollover(args []string) {
+	var err error
+	switch {
+	case len(args) == 1 && args[0] == "promote":
+		err = promote()
+	case len(args) == 1 && args[0] == "rollback":
+		err = rollback()
+	default:
+		usage()
+	}
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+}
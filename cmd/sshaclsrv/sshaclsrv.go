@@ -1,29 +1,63 @@
 package main
 
 import (
-	"bytes"
 	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"net"
 	"os"
-	"time"
+	_ "time/tzdata" // Embed time zones for access windows.
 
-	"github.com/aurora-is-near/sshaclsrv/src/util"
+	"github.com/aurora-is-near/sshaclsrv/src/stringduration"
 
 	"github.com/aurora-is-near/sshaclsrv/src/fileperm"
 	"github.com/aurora-is-near/sshaclsrv/src/gosshacl"
+	"github.com/aurora-is-near/sshaclsrv/src/sshkey"
 )
 
+// Repository is a remote key repository.
+type Repository struct {
+	URL     string
+	Token   string                  `json:",omitempty"`
+	Timeout stringduration.Duration `json:",omitempty"` // Timeout per request, defaults to 5 seconds.
+}
+
 // Settings contain global settings for the program.
 type Settings struct {
-	URL       string
-	Token     string `json:",omitempty"`
-	PublicKey ed25519.PublicKey
-	KeyFile   string
-	Hostname  string `json:",omitempty"`
+	URL              string
+	Token            string                  `json:",omitempty"`
+	Repositories     []Repository            `json:",omitempty"` // Replaces URL and Token if set.
+	RaceRepositories bool                    `json:",omitempty"` // Query all repositories concurrently.
+	RemoteTimeout    stringduration.Duration `json:",omitempty"` // Time budget across all repositories.
+	PublicKey        ed25519.PublicKey
+	KeyFile          string
+	KeyDir           string                  `json:",omitempty"` // Directory of *.keys fragments searched after KeyFile.
+	Hostname         string                  `json:",omitempty"`
+	HostAddresses    bool                    `json:",omitempty"` // Also identify by the addresses of local interfaces.
+	AddressNetworks  []string                `json:",omitempty"` // Limit HostAddresses to addresses in these networks.
+	CacheDir         string                  `json:",omitempty"` // Directory to cache remote responses in.
+	CacheMaxAge      stringduration.Duration `json:",omitempty"` // Maximum staleness of cached responses.
+	CacheNegativeTTL stringduration.Duration `json:",omitempty"` // Lifetime of cached not-found responses.
+	SyncInterval     stringduration.Duration `json:",omitempty"` // Interval of sync mode, defaults to 5 minutes.
+	SyncRetry        stringduration.Duration `json:",omitempty"` // First retry delay after a failed sync.
+	SyncJitter       stringduration.Duration `json:",omitempty"` // Maximum random delay added to sync intervals.
+	StatusFile       string                  `json:",omitempty"` // Sync status, defaults to KeyFile + ".status".
+	RequireManifest  bool                    `json:",omitempty"` // Refuse fetched keyfiles without manifest.
+	SerialFile       string                  `json:",omitempty"` // Highest accepted serial, default KeyFile + ".serial".
+	RevocationFile   string                  `json:",omitempty"` // Cached revocation list, default KeyFile + ".revoked".
+	AuditLog         string                  `json:",omitempty"` // File to append audit records to, or "syslog".
+	IndexKeyFile     bool                    `json:",omitempty"` // Compile fetched keyfiles into an index.
+	SignedKeyFile    bool                    `json:",omitempty"` // Keep signatures in the keyfile and verify them.
+	RolloverWindow   stringduration.Duration `json:",omitempty"` // Search the previous keyfile this long after fetches if the new one cannot be read.
+	TLS              *gosshacl.TLSSettings   `json:",omitempty"` // Trust configuration for all repositories.
+
+	tlsConfig *tls.Config
+	tlsErr    error    // Invalid TLS settings, which disable remote lookups.
+	aliases   []string // Addresses of local interfaces if HostAddresses is set.
 }
 
 var config = &Settings{
@@ -38,6 +72,10 @@ var (
 	configFile  string
 	username    string
 	fingerprint string
+	keyType     string
+	key         string
+	keyID       string
+	connection  string
 	generate    bool
 	fetch       bool
 )
@@ -55,21 +93,92 @@ func readConfig(filename string) error {
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(d, config)
+	if err := json.Unmarshal(d, config); err != nil {
+		return err
+	}
+	if config.tlsConfig, config.tlsErr = config.TLS.Config(); config.tlsErr != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%s TLS settings: %s, remote repositories disabled.\n", os.Args[0], config.tlsErr)
+	}
+	return nil
+}
+
+// remotes returns the configured remote repositories, or nil if remote lookups are not configured.
+func (settings *Settings) remotes() *gosshacl.RemoteSet {
+	if len(settings.PublicKey) < ed25519.PublicKeySize {
+		return nil
+	}
+	repositories := settings.Repositories
+	if len(repositories) == 0 && settings.URL != "" {
+		repositories = []Repository{{URL: settings.URL, Token: settings.Token}}
+	}
+	if len(repositories) == 0 {
+		return nil
+	}
+	set := gosshacl.NewRemoteSet(settings.RaceRepositories, settings.RemoteTimeout.Duration())
+	set.Err = settings.tlsErr
+	for _, repository := range repositories {
+		remote := gosshacl.NewRemote(repository.URL, settings.PublicKey, repository.Token, settings.Hostname)
+		remote.Timeout = repository.Timeout.Duration()
+		remote.TLSConfig = settings.tlsConfig
+		remote.Aliases = settings.aliases
+		remote.Cache = settings.cache()
+		set.Remotes = append(set.Remotes, remote)
+	}
+	return set
+}
+
+// files returns the configured local keyfiles.
+func (settings *Settings) files() *gosshacl.Files {
+	files := &gosshacl.Files{
+		KeyFile:        settings.KeyFile,
+		KeyDir:         settings.KeyDir,
+		RolloverWindow: settings.RolloverWindow.Duration(),
+	}
+	if settings.SignedKeyFile {
+		files.PublicKey = settings.PublicKey
+	}
+	return files
+}
+
+// cache returns the configured cache for remote responses, or nil if caching is not configured.
+func (settings *Settings) cache() *gosshacl.Cache {
+	if settings.CacheDir == "" || len(settings.PublicKey) < ed25519.PublicKeySize {
+		return nil
+	}
+	return gosshacl.NewCache(settings.CacheDir, settings.PublicKey, settings.Hostname, settings.CacheMaxAge.Duration(), settings.CacheNegativeTTL.Duration())
 }
 
 func init() {
 	flag.StringVar(&configFile, "c", "/etc/ssh/sshacl.cfg", "path to configuration file")
 	flag.StringVar(&username, "u", "", "username")
 	flag.StringVar(&fingerprint, "f", "", "fingerprint")
+	flag.StringVar(&keyType, "t", "", "key type")
+	flag.StringVar(&key, "k", "", "key")
+	flag.StringVar(&keyID, "i", "", "certificate key ID (principals)")
+	flag.StringVar(&connection, "C", "", "connection endpoints")
 	flag.BoolVar(&generate, "g", false, "generate example config")
 	flag.BoolVar(&fetch, "fetch", false, "fetch keyfile")
 }
 
+func usage() {
+	_, _ = fmt.Fprintf(os.Stderr, "%s -u <username> -f <fingerprint> [-t <keytype> -k <key>] [-C <connection>]\n", os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "%s principals -u <username> -i <keyid> [-C <connection>]\n", os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "%s -fetch\n", os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "%s sync\n", os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "%s check [-c <configfile>] [keyfile]\n", os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "%s rollover [-c <configfile>] promote|rollback\n", os.Args[0])
+	os.Exit(1)
+}
+
 func main() {
-	flag.Parse()
-	if generate && fetch {
-		_, _ = fmt.Fprintf(os.Stderr, "%s can't use -g(enerate) and -fetch at the same time.\n", os.Args[0])
+	var mode string
+	args := os.Args[1:]
+	if len(args) > 0 && len(args[0]) > 0 && args[0][0] != '-' {
+		mode, args = args[0], args[1:]
+	}
+	_ = flag.CommandLine.Parse(args)
+	if generate && (fetch || mode != "") {
+		_, _ = fmt.Fprintf(os.Stderr, "%s can't use -g(enerate) with -fetch or a mode.\n", os.Args[0])
 		os.Exit(1)
 	}
 	if generate {
@@ -78,42 +187,13 @@ func main() {
 		_, _ = os.Stdout.Write([]byte("\n"))
 		os.Exit(0)
 	}
+	if mode == "check" {
+		check(flag.Args())
+	}
 	if err := readConfig(configFile); err != nil {
 		_, _ = fmt.Fprintf(os.Stderr, "error reading configfile: %s\n", err)
 		os.Exit(1)
 	}
-	if fetch {
-		if config.URL != "" && len(config.PublicKey) >= ed25519.PublicKeySize {
-			dlFile := fmt.Sprintf("%s.dl-%d", config.KeyFile, time.Now().Unix())
-			buf := new(bytes.Buffer)
-			remote := gosshacl.NewRemote(config.URL, config.PublicKey, config.Token, config.Hostname)
-			if err := remote.Fetch(buf); err != nil {
-				_, _ = fmt.Fprintln(os.Stderr, err)
-				os.Exit(2)
-			}
-			if err := util.WriteFile(dlFile, "%s\n", buf.String()); err != nil {
-				_, _ = fmt.Fprintln(os.Stderr, err)
-				os.Exit(2)
-			}
-			defer func() { _ = os.Remove(dlFile) }()
-			if err := os.Chmod(dlFile, 0600); err != nil {
-				_, _ = fmt.Fprintln(os.Stderr, err)
-				os.Exit(2)
-			}
-			if err := os.Rename(dlFile, config.KeyFile); err != nil {
-				_, _ = fmt.Fprintln(os.Stderr, err)
-				os.Exit(2)
-			}
-			os.Exit(0)
-		} else {
-			_, _ = fmt.Fprintf(os.Stderr, "%s missing URL or verification key.\n", os.Args[0])
-			os.Exit(1)
-		}
-	}
-	if username == "" || fingerprint == "" || configFile == "" {
-		_, _ = fmt.Fprintf(os.Stderr, "%s -u <username> -f <fingerprint>\n", os.Args[0])
-		os.Exit(1)
-	}
 	if config.Hostname == "" {
 		var hostname string
 		var err error
@@ -123,21 +203,145 @@ func main() {
 		}
 		config.Hostname = hostname
 	}
-	if config.URL != "" && len(config.PublicKey) >= ed25519.PublicKeySize {
-		remote := gosshacl.NewRemote(config.URL, config.PublicKey, config.Token, config.Hostname)
-		err := remote.FindEntry(os.Stdout, username, fingerprint)
-		switch err {
-		case nil, gosshacl.ErrNotFound:
-			os.Exit(0)
-		case gosshacl.ErrFallback:
-		default:
+	if config.HostAddresses {
+		var err error
+		if config.aliases, err = localAddresses(config.AddressNetworks); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "cannot determine host addresses: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	switch {
+	case mode == "sync":
+		syncLoop(requireRemotes())
+	case mode == "principals":
+		principals()
+	case mode == "rollover":
+		rollover(flag.Args())
+	case mode != "":
+		usage()
+	case fetch:
+		if _, _, err := fetchKeyfile(requireRemotes()); err != nil {
 			_, _ = fmt.Fprintln(os.Stderr, err)
 			os.Exit(2)
 		}
+	default:
+		lookup()
 	}
-	if err := gosshacl.FindEntryFromFile(config.KeyFile, os.Stdout, config.Hostname, username, fingerprint); err != nil {
+	os.Exit(0)
+}
+
+// requireRemotes returns the configured remote repositories or exits.
+func requireRemotes() *gosshacl.RemoteSet {
+	remotes := config.remotes()
+	if remotes == nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%s missing URL or verification key.\n", os.Args[0])
+		os.Exit(1)
+	}
+	return remotes
+}
+
+// lookup writes the authorized keys for the login attempt given on the command line to stdout.
+func lookup() {
+	if username == "" || (fingerprint == "" && key == "") || configFile == "" {
+		usage()
+	}
+	query := gosshacl.NewQuery(username, fingerprint)
+	query.Result = new(gosshacl.Result)
+	query.Aliases = config.aliases
+	if key != "" {
+		if err := query.SetKey(keyType, key); err != nil {
+			audit(query, err)
+			_, _ = fmt.Fprintf(os.Stderr, "invalid key: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	setConnection(query)
+	setRevocations(query)
+	find(query)
+}
+
+// principals writes the principals for the certificate login given on the command line to stdout.
+func principals() {
+	if username == "" || keyID == "" || configFile == "" {
+		usage()
+	}
+	query, err := gosshacl.NewPrincipalQuery(username, keyID)
+	if err != nil {
+		audit(&gosshacl.Query{User: username, KeyID: keyID}, err)
+		_, _ = fmt.Fprintf(os.Stderr, "%s: %q\n", err, keyID)
+		os.Exit(1)
+	}
+	query.Result = new(gosshacl.Result)
+	query.Aliases = config.aliases
+	setConnection(query)
+	setRevocations(query)
+	find(query)
+}
+
+// localAddresses returns the IPv4 unicast addresses of the local interfaces, except for loopback and link-local ones,
+// limited to those within networks if not empty. IPv6 addresses contain the field delimiter of entries and can never
+// match, so IPv6 networks are refused.
+func localAddresses(networks []string) ([]string, error) {
+	allowed, err := sshkey.ParseNetworks(networks)
+	if err != nil {
+		return nil, fmt.Errorf("AddressNetworks: %s", err)
+	}
+	for _, n := range allowed {
+		if n.IP.To4() == nil {
+			return nil, fmt.Errorf("AddressNetworks: IPv6 network %s cannot identify hosts", n)
+		}
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		n, ok := addr.(*net.IPNet)
+		if !ok || !n.IP.IsGlobalUnicast() || n.IP.To4() == nil || (len(allowed) > 0 && !sshkey.ContainsAddress(allowed, n.IP)) {
+			continue
+		}
+		ret = append(ret, n.IP.String())
+	}
+	return ret, nil
+}
+
+// setConnection sets the client address of the query from the connection given on the command line, if any.
+func setConnection(query *gosshacl.Query) {
+	if connection == "" {
+		return
+	}
+	if err := query.SetConnection(connection); err != nil {
+		audit(query, err)
+		_, _ = fmt.Fprintf(os.Stderr, "%s: %q\n", err, connection)
+		os.Exit(1)
+	}
+}
+
+// find writes the result of the query to stdout, records it in the audit log and exits on error.
+func find(query *gosshacl.Query) {
+	err := findEntry(query)
+	audit(query, err)
+	switch err {
+	case nil, gosshacl.ErrNotFound:
+	default:
 		_, _ = fmt.Fprintln(os.Stderr, err)
 		os.Exit(2)
 	}
-	os.Exit(0)
+}
+
+// findEntry looks up the query in the remote repositories, the cache and the local file, in this order.
+func findEntry(query *gosshacl.Query) error {
+	if remotes := config.remotes(); remotes != nil {
+		err := remotes.FindEntry(os.Stdout, query)
+		if err != gosshacl.ErrFallback {
+			return err
+		}
+		if cache := config.cache(); cache != nil {
+			if err := cache.FindEntry(os.Stdout, query); err != gosshacl.ErrFallback {
+				return err
+			}
+		}
+	}
+	return config.files().FindEntry(os.Stdout, config.Hostname, query)
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/aurora-is-near/sshaclsrv/src/gosshacl"
+)
+
+const (
+	defaultSyncInterval = time.Minute * 5
+	defaultSyncRetry    = time.Second * 10
+)
+
+// syncStatus is written to the status file after every sync attempt.
+type syncStatus struct {
+	LastSuccess   time.Time
+	LastChange    time.Time
+	LastError     string `json:",omitempty"`
+	LastErrorTime time.Time
+	Entries       int
+	Failures      int // Consecutive failures.
+}
+
+func (status *syncStatus) write(filename string) error {
+	d, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(path.Dir(filename), path.Base(filename)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+	_, err = f.Write(append(d, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// syncDelay returns the delay before the next sync attempt. Consecutive failures back off exponentially from the
+// retry delay up to the sync interval. A random jitter is added to every delay.
+func syncDelay(failures int, interval, retry, jitter time.Duration, rnd *rand.Rand) time.Duration {
+	delay := interval
+	if failures > 0 {
+		delay = retry
+		for i := 1; i < failures && delay < interval; i++ {
+			delay *= 2
+		}
+		delay = minDuration(delay, interval)
+	}
+	if jitter > 0 {
+		delay += time.Duration(rnd.Int63n(int64(jitter)))
+	}
+	return delay
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// syncLoop fetches the keyfile periodically until SIGTERM or SIGINT is received.
+func syncLoop(remotes *gosshacl.RemoteSet) {
+	interval, retry := config.SyncInterval.Duration(), config.SyncRetry.Duration()
+	if interval <= 0 {
+		interval = defaultSyncInterval
+	}
+	if retry <= 0 {
+		retry = defaultSyncRetry
+	}
+	statusFile := config.StatusFile
+	if statusFile == "" {
+		statusFile = config.KeyFile + ".status"
+	}
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	status := new(syncStatus)
+	for {
+		changed, entries, err := fetchKeyfile(remotes)
+		now := time.Now()
+		if err != nil {
+			status.Failures++
+			status.LastError = err.Error()
+			status.LastErrorTime = now
+			log.Printf("sync failed (%d): %s", status.Failures, err)
+		} else {
+			status.Failures = 0
+			status.LastSuccess = now
+			status.Entries = entries
+			if changed {
+				status.LastChange = now
+				log.Printf("keyfile updated, %d entries", entries)
+			}
+		}
+		if err := status.write(statusFile); err != nil {
+			log.Printf("cannot write status file: %s", err)
+		}
+		select {
+		case <-time.After(syncDelay(status.Failures, interval, retry, config.SyncJitter.Duration(), rnd)):
+		case sig := <-signals:
+			log.Printf("received %s, stopping", sig)
+			return
+		}
+	}
+}
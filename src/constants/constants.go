@@ -5,4 +5,12 @@ const (
 	PerKeyPath = "key"
 	// PerHostPath is the URL path endpoint for per-host lookups.
 	PerHostPath = "host"
+	// RevocationPath is the URL path endpoint of the revocation list.
+	RevocationPath = "revoked"
+	// RolloverExtension is appended to a keyfile name to name its previous generation.
+	RolloverExtension = ".rollover"
+	// KeyIDPrefix marks certificate key IDs in place of key fingerprints.
+	KeyIDPrefix = "@"
+	// GroupPrefix marks Unix group references in place of system user names.
+	GroupPrefix = "@"
 )
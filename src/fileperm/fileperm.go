@@ -16,6 +16,8 @@ var (
 	ErrIrregular = errors.New("not a regular file")
 	// ErrOwner is returned for files that are owned by anybody but root or process owner.
 	ErrOwner = errors.New("not owned by root or process")
+	// ErrNotDirectory is returned if a directory was expected.
+	ErrNotDirectory = errors.New("not a directory")
 )
 
 func modeCheck(mode fs.FileMode) error {
@@ -39,6 +41,15 @@ func linkCheck(filename string) error {
 	return ErrIrregular
 }
 
+func ownerCheck(info os.FileInfo) error {
+	if s, ok := info.Sys().(*syscall.Stat_t); ok {
+		if s.Uid != 0 && int(s.Uid) != os.Geteuid() {
+			return ErrOwner
+		}
+	}
+	return nil
+}
+
 // PermissionCheck verifies that an open file is 1) Regular 2) Not writeable by group/other 3) Owned by root or eUID.
 // Both the file handle and the full path to file are required. The file must have been opened by absolute path.
 func PermissionCheck(file *os.File) error {
@@ -51,13 +62,34 @@ func PermissionCheck(file *os.File) error {
 	if err := modeCheck(mode); err != nil {
 		return err
 	}
-	if s, ok := info.Sys().(*syscall.Stat_t); ok {
-		if s.Uid != 0 && int(s.Uid) != os.Geteuid() {
-			return ErrOwner
-		}
+	if err := ownerCheck(info); err != nil {
+		return err
 	}
 	if err := linkCheck(file.Name()); err != nil {
 		return err
 	}
 	return nil
 }
+
+// DirPermissionCheck verifies that an open directory is 1) A directory 2) Not writeable by group/other 3) Owned by root or eUID.
+func DirPermissionCheck(dir *os.File) error {
+	const writePerm = fs.FileMode(uint32(0b0000010010))
+	var err error
+	var info os.FileInfo
+	if info, err = dir.Stat(); err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return ErrNotDirectory
+	}
+	if info.Mode()&writePerm != 0 {
+		return ErrWriteable
+	}
+	if err := ownerCheck(info); err != nil {
+		return err
+	}
+	if err := linkCheck(dir.Name()); err != nil {
+		return err
+	}
+	return nil
+}
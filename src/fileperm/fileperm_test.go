@@ -96,3 +96,23 @@ func TestSymlink(t *testing.T) {
 		t.Errorf("symlink not detected")
 	}
 }
+
+func TestDirectory(t *testing.T) {
+	d, err := ioutil.TempDir(os.TempDir(), "go_permcheck_testuid.*")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %s", err)
+	}
+	defer func() { _ = os.RemoveAll(d) }()
+	f, err := os.Open(d)
+	if err != nil {
+		t.Fatalf("Cannot open directory: %s", err)
+	}
+	defer func() { _ = f.Close() }()
+	if err := DirPermissionCheck(f); err != nil {
+		t.Errorf("error on self owned directory: %s", err)
+	}
+	_ = os.Chmod(d, 0777)
+	if err := DirPermissionCheck(f); err != ErrWriteable {
+		t.Errorf("group/other write bits not detected: %s", err)
+	}
+}
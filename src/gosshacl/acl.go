@@ -11,6 +11,10 @@ import (
 	"time"
 	"unicode"
 
+	"github.com/aurora-is-near/sshaclsrv/src/constants"
+
+	"github.com/aurora-is-near/sshaclsrv/src/sshkey"
+
 	"github.com/aurora-is-near/sshaclsrv/src/hostmatch"
 
 	"github.com/aurora-is-near/sshaclsrv/src/delegatesign"
@@ -20,8 +24,9 @@ const (
 	lineDelim         = '\n'
 	fieldDelim        = ':'
 	comment           = '#'
-	rolloverExtension = ".rollover"
+	rolloverExtension = constants.RolloverExtension
 	expireTimeFormat  = "20060102150405"
+	validityDelim     = "-"
 )
 
 var (
@@ -32,16 +37,35 @@ type aclEntry struct {
 	Hostname      string
 	User          string
 	KeyHash       string
+	NotBefore     time.Time
 	NotAfter      time.Time
 	AuthorizedKey string
+	sshkey.Conditions
 }
 
 func (e aclEntry) String() string {
 	var tS string
 	if !e.NotAfter.IsZero() {
-		tS = e.NotAfter.Format(expireTimeFormat)
+		tS = e.NotAfter.UTC().Format(expireTimeFormat)
+	}
+	if !e.NotBefore.IsZero() {
+		tS = e.NotBefore.UTC().Format(expireTimeFormat) + validityDelim + tS
 	}
-	return fmt.Sprintf("%s:%s:%s:%s:%s", e.Hostname, e.User, e.KeyHash, tS, e.AuthorizedKey)
+	return fmt.Sprintf("%s:%s:%s:%s%s:%s", e.Hostname, e.User, e.KeyHash, tS, e.Conditions, e.AuthorizedKey)
+}
+
+// conditionsMet returns true if the access windows of the entry are open at now, and the client address of q is
+// within its source networks, if both are known.
+func (e aclEntry) conditionsMet(q *Query, now time.Time) bool {
+	if len(e.SourceNetworks) > 0 && q.ClientAddress != nil && !sshkey.ContainsAddress(e.SourceNetworks, q.ClientAddress) {
+		return false
+	}
+	return e.Conditions.Open(now)
+}
+
+// authorizedKey returns the authorized key of the entry with options that enforce its conditions.
+func (e aclEntry) authorizedKey() string {
+	return sshkey.AddSourceOption(e.AuthorizedKey, e.SourceNetworks)
 }
 
 func (e aclEntry) Sign(publicKey delegatesign.DelegatedKey, privateKey ed25519.PrivateKey) string {
@@ -58,16 +82,33 @@ const (
 	userFieldAuthorizedKey
 )
 
-func parseExpire(e []byte) time.Time {
-	var expt time.Time
-	var err error
-	if len(e) > 0 {
-		if expt, err = time.Parse(expireTimeFormat, string(e)); err != nil {
-			return killTime
+// parseExpire parses a time of the validity field, which may be empty.
+func parseExpire(e string) (time.Time, error) {
+	if len(e) == 0 {
+		return time.Time{}, nil
+	}
+	return time.Parse(expireTimeFormat, e)
+}
+
+// parseValidity parses the validity field, "[<notbefore>-]<notafter>[?<conditions>]". Either time may be empty.
+func parseValidity(field []byte) (notBefore, notAfter time.Time, conditions sshkey.Conditions, err error) {
+	validity, query := sshkey.SplitConditions(string(field))
+	if query != "" {
+		if conditions, err = sshkey.ParseConditions(query); err != nil {
+			return notBefore, notAfter, conditions, fmt.Errorf("%s in '%s'", err, query)
 		}
-		return expt
 	}
-	return time.Time{}
+	start, end := "", validity
+	if p := strings.Index(validity, validityDelim); p >= 0 {
+		start, end = validity[:p], validity[p+len(validityDelim):]
+	}
+	if notBefore, err = parseExpire(start); err != nil {
+		return notBefore, notAfter, conditions, fmt.Errorf("unparsable start time '%s'", start)
+	}
+	if notAfter, err = parseExpire(end); err != nil {
+		return notBefore, notAfter, conditions, fmt.Errorf("unparsable expiry '%s'", end)
+	}
+	return notBefore, notAfter, conditions, nil
 }
 
 func newEntry(fields [][]byte) *aclEntry {
@@ -82,7 +123,11 @@ func newEntry(fields [][]byte) *aclEntry {
 	ret.Hostname = string(fields[userFieldHostname])
 	ret.User = string(fields[userFieldUsername])
 	ret.KeyHash = string(fields[userFieldKeyHash])
-	ret.NotAfter = parseExpire(fields[userFieldExpireTime])
+	var err error
+	if ret.NotBefore, ret.NotAfter, ret.Conditions, err = parseValidity(fields[userFieldExpireTime]); err != nil {
+		// Malformed fields are treated as expired.
+		ret.NotBefore, ret.NotAfter, ret.Conditions = time.Time{}, killTime, sshkey.Conditions{}
+	}
 	ret.AuthorizedKey = authkey
 	return ret
 }
@@ -118,23 +163,64 @@ func parseLine(line []byte) *aclEntry {
 	return newEntry(fields)
 }
 
-func matchLine(line []byte, host, user, key string) (*aclEntry, bool) {
+// keyMatches verifies that the key material of the entry is consistent with its KeyHash and equals key. Problems are
+// logged with the source of the entry, if known.
+func (e aclEntry) keyMatches(key *sshkey.Key, source string) bool {
+	if source != "" {
+		source += ": "
+	}
+	k, err := sshkey.ParseKey(e.AuthorizedKey)
+	if err != nil {
+		ErrorLog.Printf("%sentry %s:%s:%s: invalid authorized key: %s", source, e.Hostname, e.User, e.KeyHash, err)
+		return false
+	}
+	if k.Fingerprint != e.KeyHash {
+		ErrorLog.Printf("%sentry %s:%s:%s: key hash does not match key material (%s)", source, e.Hostname, e.User, e.KeyHash, k.Fingerprint)
+		return false
+	}
+	return bytes.Equal(k.Key.Marshal(), key.Key.Marshal())
+}
+
+// hostMatches returns true if the hostname field of an entry matches the host or one of its aliases.
+func hostMatches(field, host string, aliases []string) bool {
+	if field == "*" || field == host {
+		return true
+	}
+	list, err := hostmatch.ParseList(field)
+	if err != nil {
+		return false
+	}
+	return list.MatchAny(append([]string{host}, aliases...)...)
+}
+
+func matchLine(line []byte, host string, q *Query) (*aclEntry, bool) {
 	e := parseLine(line)
 	if e == nil {
 		return nil, false
 	}
-	if e.Hostname != "*" && e.Hostname != host {
-		if !hostmatch.Compile(e.Hostname).Match(host) {
-			return nil, false
-		}
+	if !hostMatches(e.Hostname, host, q.Aliases) {
+		return nil, false
+	}
+	if !userMatches(e.User, q.User) {
+		return nil, false
+	}
+	now := time.Now()
+	if !e.NotAfter.IsZero() && e.NotAfter.Before(now) {
+		return nil, false
+	}
+	if !e.NotBefore.IsZero() && e.NotBefore.After(now) {
+		return nil, false
+	}
+	if !q.ignoreConditions && !e.conditionsMet(q, now) {
+		return nil, false
 	}
-	if e.User != user {
+	if e.KeyHash != q.Fingerprint || q.Fingerprint == "" || e.KeyHash == "" {
 		return nil, false
 	}
-	if !e.NotAfter.IsZero() && e.NotAfter.Before(time.Now()) {
+	if q.revoked(e, nil) {
 		return nil, false
 	}
-	if e.KeyHash != key || key == "" || e.KeyHash == "" {
+	if q.Key != nil && !e.keyMatches(q.Key, q.source) {
 		return nil, false
 	}
 	return e, true
@@ -148,14 +234,15 @@ func splitKey(key string) string {
 	return f[1]
 }
 
-func findEntry(r io.Reader, hostname, user, key string) ([]*aclEntry, error) {
+func findEntry(r io.Reader, hostname string, q *Query) ([]*aclEntry, error) {
 	var line []byte
 	var err error
 	var ret []*aclEntry
 	b := bufio.NewReader(r)
 	for {
 		line, err = b.ReadBytes(lineDelim)
-		if e, ok := matchLine(line, hostname, user, splitKey(key)); ok && e != nil {
+		if e, ok := matchLine(line, hostname, q); ok && e != nil {
+			q.addMatch(e, nil)
 			ret = append(ret, e)
 		}
 		if err != nil {
@@ -0,0 +1,123 @@
+package gosshacl
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aurora-is-near/sshaclsrv/src/fileperm"
+)
+
+const (
+	defaultNegativeTTL = time.Minute * 5
+)
+
+// Cache stores verified responses of remote lookups on disk, signatures included, to allow authentication while the
+// remote repositories are unreachable. Entries are verified again on every read.
+type Cache struct {
+	Dir         string            // Directory owned by root or the process owner, not writeable by others.
+	PublicKey   ed25519.PublicKey // Master Publickey.
+	Hostname    string            // Server's hostname.
+	MaxAge      time.Duration     // Maximum staleness of entries. Unlimited if zero.
+	NegativeTTL time.Duration     // Lifetime of not-found entries, defaults to 5 minutes.
+}
+
+// NewCache returns a new Cache that stores entries in dir.
+func NewCache(dir string, publicKey ed25519.PublicKey, hostname string, maxAge, negativeTTL time.Duration) *Cache {
+	if negativeTTL <= 0 {
+		negativeTTL = defaultNegativeTTL
+	}
+	return &Cache{
+		Dir:         dir,
+		PublicKey:   publicKey,
+		Hostname:    hostname,
+		MaxAge:      maxAge,
+		NegativeTTL: negativeTTL,
+	}
+}
+
+// cacheFile returns the filename of the cache entry for the query, or an empty string if the query cannot be used
+// safely in a path.
+func (cache *Cache) cacheFile(q *Query) string {
+	if q.User == "" || q.Fingerprint == "" || strings.ContainsAny(q.User, "/\\") || q.User[0] == '.' {
+		return ""
+	}
+	fingerprint := strings.NewReplacer("+", "-", "/", "_").Replace(q.Fingerprint)
+	return path.Join(cache.Dir, fingerprint+"."+q.User)
+}
+
+func (cache *Cache) openDir() error {
+	if err := os.MkdirAll(cache.Dir, 0700); err != nil {
+		return err
+	}
+	d, err := os.Open(cache.Dir)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = d.Close() }()
+	return fileperm.DirPermissionCheck(d)
+}
+
+// store writes signed lines for the query to the cache. Empty lines are stored as not-found entry.
+// Errors are ignored since caching must never change the result of a lookup.
+func (cache *Cache) store(q *Query, lines []byte) {
+	filename := cache.cacheFile(q)
+	if filename == "" || cache.openDir() != nil {
+		return
+	}
+	f, err := ioutil.TempFile(cache.Dir, ".tmp-")
+	if err != nil {
+		return
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+	_, err = f.Write(lines)
+	if closeErr := f.Close(); err != nil || closeErr != nil {
+		return
+	}
+	_ = os.Rename(f.Name(), filename)
+}
+
+// FindEntry looks up cached keys matching the query and writes them to w. It returns ErrNotFound for a fresh
+// not-found entry and ErrFallback if the cache holds no usable entry.
+func (cache *Cache) FindEntry(w io.Writer, q *Query) error {
+	filename := cache.cacheFile(q)
+	if filename == "" {
+		return ErrFallback
+	}
+	q.begin(BackendCache, filename)
+	f, err := os.Open(filename)
+	if err != nil {
+		return ErrFallback
+	}
+	defer func() { _ = f.Close() }()
+	if err := fileperm.PermissionCheck(f); err != nil {
+		return ErrFallback
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return ErrFallback
+	}
+	age := time.Since(info.ModTime())
+	if info.Size() == 0 {
+		if age > cache.NegativeTTL {
+			return ErrFallback
+		}
+		return ErrNotFound
+	}
+	if cache.MaxAge > 0 && age > cache.MaxAge {
+		_ = os.Remove(filename)
+		return ErrFallback
+	}
+	verifier := &RemoteACL{PublicKey: cache.PublicKey, Hostname: cache.Hostname}
+	buf := new(bytes.Buffer)
+	if err := verifier.parseResponse(buf, f, q, false); err != nil {
+		return ErrFallback
+	}
+	_, err = io.Copy(w, buf)
+	return err
+}
@@ -0,0 +1,122 @@
+package gosshacl
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aurora-is-near/sshaclsrv/src/delegatesign"
+
+	"github.com/aurora-is-near/sshaclsrv/src/sshkey"
+)
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "cache.*")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	masterPub, entry := testSignedEntry()
+	status := http.StatusOK
+	server := testServer(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			_, _ = w.Write([]byte(entry))
+		}
+	})
+	defer server.Close()
+	cache := NewCache(dir, masterPub, "localhost", time.Hour, time.Minute)
+	remote := NewRemote(server.URL, masterPub, "", "localhost")
+	remote.Cache = cache
+	if err := cache.FindEntry(new(bytes.Buffer), NewQuery("root", tkh)); err != ErrFallback {
+		t.Errorf("empty cache must return ErrFallback: %v", err)
+	}
+	if err := remote.FindEntry(new(bytes.Buffer), NewQuery("root", tkh)); err != nil {
+		t.Fatalf("FindEntry: %s", err)
+	}
+	w := new(bytes.Buffer)
+	if err := cache.FindEntry(w, NewQuery("root", tkh)); err != nil {
+		t.Fatalf("Cache.FindEntry: %s", err)
+	}
+	if strings.TrimSpace(w.String()) != ok {
+		t.Error("wrong key")
+	}
+	if err := cache.FindEntry(new(bytes.Buffer), NewQuery("nobody", tkh)); err != ErrFallback {
+		t.Errorf("other user must return ErrFallback: %v", err)
+	}
+	filename := cache.cacheFile(NewQuery("root", tkh))
+	old := time.Now().Add(-time.Hour * 2)
+	_ = os.Chtimes(filename, old, old)
+	if err := cache.FindEntry(new(bytes.Buffer), NewQuery("root", tkh)); err != ErrFallback {
+		t.Errorf("stale entry must return ErrFallback: %v", err)
+	}
+	status = http.StatusNotFound
+	if err := remote.FindEntry(new(bytes.Buffer), NewQuery("root", tkh)); err != ErrNotFound {
+		t.Fatalf("FindEntry must return ErrNotFound: %v", err)
+	}
+	if err := cache.FindEntry(new(bytes.Buffer), NewQuery("root", tkh)); err != ErrNotFound {
+		t.Errorf("negative entry must return ErrNotFound: %v", err)
+	}
+	_ = os.Chtimes(filename, old, old)
+	if err := cache.FindEntry(new(bytes.Buffer), NewQuery("root", tkh)); err != ErrFallback {
+		t.Errorf("expired negative entry must return ErrFallback: %v", err)
+	}
+}
+
+func TestCacheTampered(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "cache.*")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	masterPub, entry := testSignedEntry()
+	cache := NewCache(dir, masterPub, "localhost", 0, 0)
+	cache.store(NewQuery("root", tkh), []byte(strings.Replace(entry, "localhost", "localhosx", 1)+"\n"))
+	if err := cache.FindEntry(new(bytes.Buffer), NewQuery("root", tkh)); err != ErrFallback {
+		t.Errorf("tampered entry must return ErrFallback: %v", err)
+	}
+	cache.store(NewQuery("root", tkh), []byte(entry+"\n"))
+	if err := cache.FindEntry(new(bytes.Buffer), NewQuery("root", tkh)); err != nil {
+		t.Errorf("Cache.FindEntry: %s", err)
+	}
+}
+
+func TestCacheSourceNetworks(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "cache.*")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	masterPub, masterPriv, _ := ed25519.GenerateKey(rand.Reader)
+	subPub, subPriv, _ := ed25519.GenerateKey(rand.Reader)
+	e := parseLine([]byte(te))
+	e.SourceNetworks, _ = sshkey.ParseNetworks([]string{"10.0.0.0/8"})
+	entry := e.Sign(delegatesign.DelegateKey(masterPriv, subPub, time.Now().Add(time.Minute)), subPriv)
+	server := testServer(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(entry))
+	})
+	defer server.Close()
+	cache := NewCache(dir, masterPub, "localhost", time.Hour, time.Minute)
+	remote := NewRemote(server.URL, masterPub, "", "localhost")
+	remote.Cache = cache
+	outside := NewQuery("root", tkh)
+	_ = outside.SetConnection("192.168.0.1 52000 10.0.0.1 22")
+	if err := remote.FindEntry(new(bytes.Buffer), outside); err != ErrNotFound {
+		t.Fatalf("client outside networks must return ErrNotFound: %v", err)
+	}
+	inside := NewQuery("root", tkh)
+	_ = inside.SetConnection("10.1.2.3 52000 10.0.0.1 22")
+	w := new(bytes.Buffer)
+	if err := cache.FindEntry(w, inside); err != nil {
+		t.Fatalf("mismatching address must not store a negative entry: %v", err)
+	}
+	if w.String() != `from="10.0.0.0/8" `+ok+"\n" {
+		t.Errorf("wrong key: %q", w.String())
+	}
+}
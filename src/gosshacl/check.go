@@ -0,0 +1,132 @@
+package gosshacl
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aurora-is-near/sshaclsrv/src/constants"
+
+	"github.com/aurora-is-near/sshaclsrv/src/manifest"
+
+	"github.com/aurora-is-near/sshaclsrv/src/sshkey"
+)
+
+// Diagnostic is a problem found in a keyfile line.
+type Diagnostic struct {
+	Line    int    // Line number, starting at 1.
+	Message string // Description of the problem.
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%d: %s", d.Line, d.Message)
+}
+
+type checker struct {
+	verifier    *RemoteACL
+	seen        map[string]int
+	diagnostics []Diagnostic
+	line        int
+}
+
+func (c *checker) report(format string, v ...interface{}) {
+	c.diagnostics = append(c.diagnostics, Diagnostic{Line: c.line, Message: fmt.Sprintf(format, v...)})
+}
+
+// Check parses a keyfile like lookups do and returns a diagnostic for every line that is malformed, expired, has
+// inconsistent key material or duplicates an earlier line. If publicKey is not nil, the keyfile must contain signed
+// lines and every signature is verified.
+func Check(r io.Reader, publicKey ed25519.PublicKey) ([]Diagnostic, error) {
+	c := &checker{seen: make(map[string]int)}
+	if publicKey != nil {
+		c.verifier = &RemoteACL{PublicKey: publicKey}
+	}
+	b := bufio.NewReader(r)
+	for {
+		line, err := b.ReadBytes(lineDelim)
+		c.line++
+		c.checkLine(bytes.TrimSpace(line))
+		if err == io.EOF {
+			return c.diagnostics, nil
+		}
+		if err != nil {
+			return c.diagnostics, err
+		}
+	}
+}
+
+func (c *checker) checkLine(line []byte) {
+	if len(line) == 0 || line[0] == comment {
+		return
+	}
+	if c.verifier != nil {
+		sig, msg := splitLine(line)
+		if _, ok := c.verifier.verifyLine(sig, msg); !ok {
+			c.report("invalid signature")
+			return
+		}
+		if line = msg; manifest.IsManifest(line) {
+			return
+		}
+	}
+	fields := cutFields(line, func(r rune) bool { return r == fieldDelim })
+	if len(fields) <= userFieldAuthorizedKey {
+		c.report("expected %d fields, found %d", userFieldAuthorizedKey+1, len(fields))
+		return
+	}
+	for i, name := range []string{"hostname", "user", "key hash"} {
+		if len(fields[i]) == 0 {
+			c.report("empty %s", name)
+		}
+	}
+	c.checkValidity(fields[userFieldExpireTime])
+	e := newEntry(fields)
+	if e == nil {
+		c.report("empty authorized key")
+		return
+	}
+	c.checkKey(e)
+	id := string(line)
+	if first, ok := c.seen[id]; ok {
+		c.report("duplicate of line %d", first)
+	} else {
+		c.seen[id] = c.line
+	}
+}
+
+func (c *checker) checkValidity(field []byte) {
+	start, end, _, err := parseValidity(field)
+	if err != nil {
+		c.report("%s", err)
+		return
+	}
+	if end.IsZero() {
+		return
+	}
+	if end.Before(time.Now()) {
+		c.report("expired at %s", end.Format(time.RFC3339))
+	} else if end.Before(start) {
+		c.report("expires before it starts")
+	}
+}
+
+func (c *checker) checkKey(e *aclEntry) {
+	if strings.HasPrefix(e.KeyHash, constants.KeyIDPrefix) {
+		if strings.ContainsAny(e.AuthorizedKey, ", \t") {
+			c.report("invalid principal '%s'", e.AuthorizedKey)
+		}
+		return
+	}
+	k, err := sshkey.ParseKey(e.AuthorizedKey)
+	if err != nil {
+		c.report("invalid authorized key: %s", err)
+		return
+	}
+	if k.Fingerprint != e.KeyHash {
+		c.report("key hash does not match key (%s)", k.Fingerprint)
+	}
+}
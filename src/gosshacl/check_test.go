@@ -0,0 +1,54 @@
+package gosshacl
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	lines := []string{
+		"# comment",
+		te,
+		te,
+		strings.Replace(te, ":21091222030101:", ":2109122203:", 1),
+		strings.Replace(te, ":21091222030101:", ":20010101000000:", 1),
+		strings.Replace(te, tkhc, "XXX", 1),
+		strings.Replace(te, "ecdsa-sha2-nistp256", "bogus", 1),
+		"localhost:root",
+		strings.Replace(te, ":21091222030101:", ":21091222030101?window=Mon+8-18:", 1),
+		"",
+	}
+	diagnostics, err := Check(strings.NewReader(strings.Join(lines, "\n")), nil)
+	if err != nil {
+		t.Fatalf("Check: %s", err)
+	}
+	expect := map[int]string{3: "duplicate", 4: "unparsable expiry", 5: "expired", 6: "key hash", 7: "invalid authorized key", 8: "expected 5 fields", 9: "invalid access window"}
+	if len(diagnostics) != len(expect) {
+		t.Errorf("expected %d diagnostics, got %v", len(expect), diagnostics)
+	}
+	for _, d := range diagnostics {
+		if !strings.Contains(d.Message, expect[d.Line]) || expect[d.Line] == "" {
+			t.Errorf("unexpected diagnostic %s", d)
+		}
+	}
+	masterPub, entry := testSignedEntry()
+	diagnostics, _ = Check(strings.NewReader(entry+"\n"+te), masterPub)
+	if len(diagnostics) != 1 || diagnostics[0].Line != 2 || diagnostics[0].Message != "invalid signature" {
+		t.Errorf("signed check: %v", diagnostics)
+	}
+}
+
+func TestCheckValidityAgreement(t *testing.T) {
+	for _, validity := range []string{
+		"", "21091222030101", "-21091222030101", "20010101000000-21091222030101", "20010101000000-",
+		"2109122203", "x-21091222030101", "20010101000000-x", "-", "--21091222030101",
+		"21091222030101?from=10.0.0.0/8", "21091222030101?from=10.0.0.1/8", "?window=Mon+8-18", "?bogus=1",
+	} {
+		line := strings.Replace(te, ":21091222030101:", ":"+validity+":", 1)
+		diagnostics, _ := Check(strings.NewReader(line), nil)
+		e := parseLine([]byte(line))
+		if refused := e == nil || e.NotAfter.Equal(killTime); refused != (len(diagnostics) > 0) {
+			t.Errorf("%q: lookup refuses %t, check reports %v", validity, refused, diagnostics)
+		}
+	}
+}
@@ -1,15 +1,18 @@
 // Package gosshacl implements file based access control for SSH (authorizedkeyscommand).
 //
 // File format:
-//    <hostname>:<user>:<sha256_of_key>:<valid from>:<valid to>:[<authorized key entry>]
+//    <hostname>:<user>:<sha256_of_key>:[<valid from>-]<valid to>:[<authorized key entry>]
 package gosshacl
 
 import (
+	"crypto/ed25519"
 	_ "crypto/sha256" // Link sha256.
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
+	"strings"
 
 	"github.com/aurora-is-near/sshaclsrv/src/fileperm"
 )
@@ -21,6 +24,9 @@ var (
 	// ErrInvalidExpire = errors.New("invalid expire format")
 )
 
+// ErrorLog receives errors about invalid entries that are skipped during lookups.
+var ErrorLog = log.New(os.Stderr, "", 0)
+
 // AuthorizedFile is a file containing authorization information.
 type AuthorizedFile os.File
 
@@ -44,30 +50,101 @@ func (kf *AuthorizedFile) Close() {
 	_ = (*os.File)(kf).Close()
 }
 
-// FindEntry finds valid entries in the file that match user and key (its sha256 fingerprint).
+// FindEntry finds valid entries in the file that match the query.
 // It returns the authorized-keys entries that match.
-func (kf *AuthorizedFile) FindEntry(w io.Writer, hostname, user, key string) error {
-	return FindEntry((*os.File)(kf), w, hostname, user, key)
+func (kf *AuthorizedFile) FindEntry(w io.Writer, hostname string, q *Query) error {
+	return kf.findEntry(w, hostname, nil, q)
+}
+
+// FindSignedEntry finds entries in a file of signed lines that match the query and carry a valid signature by
+// publicKey, and writes them to w.
+func (kf *AuthorizedFile) FindSignedEntry(w io.Writer, hostname string, publicKey ed25519.PublicKey, q *Query) error {
+	return kf.findEntry(w, hostname, &RemoteACL{PublicKey: publicKey, Hostname: hostname}, q)
+}
+
+func (kf *AuthorizedFile) findEntry(w io.Writer, hostname string, verifier *RemoteACL, q *Query) error {
+	kf.begin(q)
+	return kf.search(w, hostname, verifier, q)
+}
+
+// begin starts recording a lookup in the file.
+func (kf *AuthorizedFile) begin(q *Query) {
+	name := (*os.File)(kf).Name()
+	if strings.HasSuffix(name, rolloverExtension) {
+		q.begin(BackendRollover, name)
+	} else {
+		q.begin(BackendLocal, name)
+	}
+}
+
+// search looks up the query in the file, using its index if possible. Matches are recorded in addition to earlier
+// ones.
+func (kf *AuthorizedFile) search(w io.Writer, hostname string, verifier *RemoteACL, q *Query) error {
+	q.source = (*os.File)(kf).Name()
+	defer func() { q.source = "" }()
+	if index := kf.index(); index != nil {
+		err := index.findEntry(w, hostname, verifier, q)
+		index.Close()
+		if err != ErrIndexInvalid {
+			return err
+		}
+	}
+	if verifier != nil {
+		return verifier.parseResponse(w, (*os.File)(kf), q, false)
+	}
+	return FindEntry((*os.File)(kf), w, hostname, q)
+}
+
+// index returns the fresh index of the file, or nil.
+func (kf *AuthorizedFile) index() *Index {
+	f := (*os.File)(kf)
+	if strings.HasSuffix(f.Name(), rolloverExtension) {
+		return nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil
+	}
+	index, err := OpenIndex(f.Name()+IndexExtension, info)
+	if err != nil {
+		return nil
+	}
+	return index
 }
 
 // FindEntryFromFile searches a file for matching keys and writes them to w.
-func FindEntryFromFile(filename string, w io.Writer, hostname, user, key string) error {
+func FindEntryFromFile(filename string, w io.Writer, hostname string, q *Query) error {
 	kf, err := New(filename)
 	if err != nil {
 		return err
 	}
 	defer kf.Close()
-	return kf.FindEntry(w, hostname, user, key)
+	return kf.FindEntry(w, hostname, q)
+}
+
+// FindSignedEntryFromFile searches a file of signed lines for matching keys with a valid signature by publicKey and
+// writes them to w.
+func FindSignedEntryFromFile(filename string, w io.Writer, hostname string, publicKey ed25519.PublicKey, q *Query) error {
+	kf, err := New(filename)
+	if err != nil {
+		return err
+	}
+	defer kf.Close()
+	return kf.FindSignedEntry(w, hostname, publicKey, q)
 }
 
 // FindEntry searches r for matching keys and writes them to w.
-func FindEntry(r io.Reader, w io.Writer, hostname, user, key string) error {
-	e, err := findEntry(r, hostname, user, key)
+func FindEntry(r io.Reader, w io.Writer, hostname string, q *Query) error {
+	e, err := findEntry(r, hostname, q)
 	if len(e) == 0 {
 		return err
 	}
+	return writeEntries(w, e)
+}
+
+func writeEntries(w io.Writer, e []*aclEntry) error {
 	for _, s := range e {
-		if _, err := fmt.Fprintln(w, s.AuthorizedKey); err != nil {
+		if _, err := fmt.Fprintln(w, s.authorizedKey()); err != nil {
 			return err
 		}
 	}
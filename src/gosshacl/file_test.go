@@ -2,8 +2,16 @@ package gosshacl
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/aurora-is-near/sshaclsrv/src/sshkey"
+
+	"golang.org/x/crypto/ssh"
 )
 
 var (
@@ -31,7 +39,157 @@ func TestFindEntryHash(t *testing.T) {
 	b := new(bytes.Buffer)
 	w := new(bytes.Buffer)
 	b.WriteString(te + "\n" + te)
-	if err := FindEntry(b, w, "localhost", "root", string(tkh)); err != nil {
+	if err := FindEntry(b, w, "localhost", NewQuery("root", string(tkh))); err != nil {
+		t.Fatalf("FindEntry: %s", err)
+	}
+	if err := FindEntry(strings.NewReader(te), new(bytes.Buffer), "localhost", NewQuery("root", tkhc)); err != ErrNotFound {
+		t.Errorf("fingerprint without prefix must not match: %v", err)
+	}
+}
+
+func TestFindEntryHostPatterns(t *testing.T) {
+	b := strings.NewReader(strings.Replace(te, "localhost", "web*.node.com,!web-canary.node.com", 1))
+	if err := FindEntry(b, new(bytes.Buffer), "web-1.node.com", NewQuery("root", tkh)); err != nil {
+		t.Errorf("FindEntry: %s", err)
+	}
+	b.Reset(strings.Replace(te, "localhost", "web*.node.com,!web-canary.node.com", 1))
+	if err := FindEntry(b, new(bytes.Buffer), "web-canary.node.com", NewQuery("root", tkh)); err != ErrNotFound {
+		t.Errorf("excluded host matched: %v", err)
+	}
+	b.Reset(strings.Replace(te, "localhost", "!web-canary.node.com", 1))
+	if err := FindEntry(b, new(bytes.Buffer), "web-1.node.com", NewQuery("root", tkh)); err != ErrNotFound {
+		t.Errorf("list of exclusions only matched: %v", err)
+	}
+}
+
+func TestFindEntryKey(t *testing.T) {
+	f := strings.Fields(tk)
+	q := NewQuery("root", tkh)
+	if err := q.SetKey(f[0], f[1]); err != nil {
+		t.Fatalf("SetKey: %s", err)
+	}
+	w := new(bytes.Buffer)
+	if err := FindEntry(strings.NewReader(te), w, "localhost", q); err != nil {
 		t.Fatalf("FindEntry: %s", err)
 	}
+	if strings.TrimSpace(w.String()) != ok {
+		t.Error("wrong key")
+	}
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	sshPub, _ := ssh.NewPublicKey(pub)
+	other := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub)))
+	log := new(bytes.Buffer)
+	ErrorLog.SetOutput(log)
+	defer ErrorLog.SetOutput(os.Stderr)
+	forged := strings.Replace(te, tk, other, 1)
+	if err := FindEntry(strings.NewReader(forged), new(bytes.Buffer), "localhost", q); err != ErrNotFound {
+		t.Errorf("entry with wrong key material must not match: %v", err)
+	}
+	if log.Len() == 0 {
+		t.Error("key hash mismatch not logged")
+	}
+	f = strings.Fields(other)
+	if err := NewQuery("root", tkh).SetKey(f[0], f[1]); err != ErrKeyMismatch {
+		t.Errorf("SetKey must detect fingerprint mismatch: %v", err)
+	}
+}
+
+func TestFindPrincipals(t *testing.T) {
+	e := &aclEntry{
+		Hostname:      "localhost",
+		User:          "root",
+		KeyHash:       "@johann@corp",
+		AuthorizedKey: "johann",
+	}
+	q, err := NewPrincipalQuery("root", "johann@corp")
+	if err != nil {
+		t.Fatalf("NewPrincipalQuery: %s", err)
+	}
+	w := new(bytes.Buffer)
+	if err := FindEntry(strings.NewReader(e.String()+"\n"+te), w, "localhost", q); err != nil {
+		t.Fatalf("FindEntry: %s", err)
+	}
+	if w.String() != "johann\n" {
+		t.Errorf("wrong principals: %q", w.String())
+	}
+	if err := FindEntry(strings.NewReader(e.String()), new(bytes.Buffer), "localhost", NewQuery("root", "@johann@corp")); err != ErrNotFound {
+		t.Errorf("key lookup must not match principal entries: %v", err)
+	}
+	if _, err := NewPrincipalQuery("root", "../x"); err != ErrInvalidKeyID {
+		t.Errorf("invalid key ID accepted: %v", err)
+	}
+}
+
+func TestFindEntryNotBefore(t *testing.T) {
+	e := parseLine([]byte(te))
+	e.NotBefore = time.Now().Add(time.Hour).Truncate(time.Second)
+	future := e.String()
+	if parsed := parseLine([]byte(future)); !parsed.NotBefore.Equal(e.NotBefore.UTC()) || !parsed.NotAfter.Equal(e.NotAfter) {
+		t.Errorf("validity not parsed: %s", future)
+	}
+	if err := FindEntry(strings.NewReader(future), new(bytes.Buffer), "localhost", NewQuery("root", tkh)); err != ErrNotFound {
+		t.Errorf("entry must not match before NotBefore: %v", err)
+	}
+	e.NotBefore = time.Now().Add(-time.Hour)
+	if err := FindEntry(strings.NewReader(e.String()), new(bytes.Buffer), "localhost", NewQuery("root", tkh)); err != nil {
+		t.Errorf("entry must match after NotBefore: %v", err)
+	}
+	malformed := strings.Replace(te, ":21091222030101:", ":2109-21091222030101:", 1)
+	if err := FindEntry(strings.NewReader(malformed), new(bytes.Buffer), "localhost", NewQuery("root", tkh)); err != ErrNotFound {
+		t.Errorf("malformed validity must not match: %v", err)
+	}
+}
+
+func TestFindEntrySourceNetworks(t *testing.T) {
+	e := parseLine([]byte(te))
+	e.SourceNetworks, _ = sshkey.ParseNetworks([]string{"10.0.0.0/8", "2001:db8::/32"})
+	restricted := e.String()
+	q := NewQuery("root", tkh)
+	if err := q.SetConnection("2001:db8::1 52000 2001:db8::2 22"); err != nil {
+		t.Fatalf("SetConnection: %s", err)
+	}
+	w := new(bytes.Buffer)
+	if err := FindEntry(strings.NewReader(restricted), w, "localhost", q); err != nil {
+		t.Fatalf("entry must match client in network: %v", err)
+	}
+	if w.String() != `from="10.0.0.0/8,2001:db8::/32" `+ok+"\n" {
+		t.Errorf("from option missing: %q", w.String())
+	}
+	_ = q.SetConnection("192.168.0.1 52000 10.0.0.1 22")
+	if err := FindEntry(strings.NewReader(restricted), new(bytes.Buffer), "localhost", q); err != ErrNotFound {
+		t.Errorf("entry must not match client outside networks: %v", err)
+	}
+	if err := FindEntry(strings.NewReader(restricted), new(bytes.Buffer), "localhost", NewQuery("root", tkh)); err != nil {
+		t.Errorf("entry must match without client address: %v", err)
+	}
+	unknown := strings.Replace(te, ":21091222030101:", ":21091222030101?window=always:", 1)
+	if err := FindEntry(strings.NewReader(unknown), new(bytes.Buffer), "localhost", NewQuery("root", tkh)); err != ErrNotFound {
+		t.Errorf("entry with unknown condition must not match: %v", err)
+	}
+	if err := q.SetConnection(""); err != ErrInvalidConnection {
+		t.Errorf("empty connection must fail: %v", err)
+	}
+}
+
+func TestFindEntryWindows(t *testing.T) {
+	e := parseLine([]byte(te))
+	always, _ := sshkey.ParseWindow("* 00:00-24:00")
+	e.Windows = []*sshkey.Window{always}
+	q := NewQuery("root", tkh)
+	q.Result = new(Result)
+	if err := FindEntry(strings.NewReader(e.String()), new(bytes.Buffer), "localhost", q); err != nil {
+		t.Fatalf("entry must match in open window: %v", err)
+	}
+	if len(q.Result.Matches) != 1 || len(q.Result.Matches[0].Windows) != 1 || q.Result.Matches[0].Windows[0] != "* 00:00-24:00" {
+		t.Errorf("window not recorded: %v", q.Result.Matches)
+	}
+	day := time.Now().UTC().Add(time.Hour * 48).Weekday().String()[:3]
+	closed, err := sshkey.ParseWindow(day + " 00:00-24:00")
+	if err != nil {
+		t.Fatalf("ParseWindow: %s", err)
+	}
+	e.Windows = append(e.Windows, closed)
+	if err := FindEntry(strings.NewReader(e.String()), new(bytes.Buffer), "localhost", NewQuery("root", tkh)); err != ErrNotFound {
+		t.Errorf("entry must not match while a window is closed: %v", err)
+	}
 }
@@ -0,0 +1,105 @@
+package gosshacl
+
+import (
+	"crypto/ed25519"
+	"io"
+	"os"
+	"time"
+)
+
+// Files describes the local keyfiles of a host.
+type Files struct {
+	KeyFile        string            // Current generation of the keyfile.
+	KeyDir         string            // Optional directory of keyfile fragments, searched after the keyfile.
+	PublicKey      ed25519.PublicKey // If not nil, files contain signed lines and only validly signed entries match.
+	RolloverWindow time.Duration     // Time after replacement of the keyfile during which its rollover is consulted if it cannot be searched.
+}
+
+// FindEntryFromFiles searches the keyfile and then the fragments in dir for matching keys and writes them to w. If
+// publicKey is not nil, only entries with a valid signature by publicKey are returned.
+func FindEntryFromFiles(filename, dir string, w io.Writer, hostname string, publicKey ed25519.PublicKey, q *Query) error {
+	files := &Files{KeyFile: filename, KeyDir: dir, PublicKey: publicKey}
+	return files.FindEntry(w, hostname, q)
+}
+
+// inRollover returns true if the keyfile was replaced within the rollover window.
+func (files *Files) inRollover() bool {
+	if files.RolloverWindow <= 0 {
+		return false
+	}
+	info, err := os.Stat(files.KeyFile)
+	return err == nil && time.Since(info.ModTime()) < files.RolloverWindow
+}
+
+// FindEntry searches the keyfile for matching keys and writes them to w. If the keyfile cannot be searched, and was
+// replaced within the rollover window, the previous generation is searched instead. Keys missing from a readable
+// keyfile were removed and never match through the previous generation. Then the
+// fragments in KeyDir are searched. Fragments that cannot be read or fail the permission check are skipped and logged
+// to ErrorLog. If the keyfile cannot be read and no fragment matches, the error of the keyfile is returned.
+func (files *Files) FindEntry(w io.Writer, hostname string, q *Query) error {
+	var verifier *RemoteACL
+	if files.PublicKey != nil {
+		verifier = &RemoteACL{PublicKey: files.PublicKey, Hostname: hostname}
+	}
+	var found bool
+	kf, fileErr := New(files.KeyFile)
+	if fileErr == nil {
+		kf.begin(q)
+		fileErr = kf.search(w, hostname, verifier, q)
+		kf.Close()
+	} else {
+		q.begin(BackendLocal, files.KeyFile)
+	}
+	if fileErr != nil && fileErr != ErrNotFound && files.inRollover() {
+		if rollover, err := openFragment(files.KeyFile + rolloverExtension); err == nil {
+			if fileErr = rollover.search(w, hostname, verifier, q); fileErr == nil {
+				q.setBackend(BackendRollover)
+			}
+			rollover.Close()
+		}
+	}
+	switch fileErr {
+	case nil:
+		found = true
+	case ErrNotFound:
+		fileErr = nil
+	}
+	if files.KeyDir != "" {
+		found = files.searchFragments(w, hostname, verifier, q) || found
+	}
+	switch {
+	case found:
+		if fileErr != nil {
+			ErrorLog.Printf("%s: %s", files.KeyFile, fileErr)
+		}
+		return nil
+	case fileErr != nil:
+		return fileErr
+	default:
+		return ErrNotFound
+	}
+}
+
+func (files *Files) searchFragments(w io.Writer, hostname string, verifier *RemoteACL, q *Query) (found bool) {
+	fragments, err := Fragments(files.KeyDir)
+	if err != nil {
+		ErrorLog.Printf("%s: %s", files.KeyDir, err)
+	}
+	for _, fragment := range fragments {
+		f, err := openFragment(fragment)
+		if err != nil {
+			ErrorLog.Printf("%s: %s", fragment, err)
+			continue
+		}
+		err = f.search(w, hostname, verifier, q)
+		f.Close()
+		switch err {
+		case nil:
+			found = true
+		case ErrNotFound:
+		default:
+			ErrorLog.Printf("%s: %s", fragment, err)
+		}
+	}
+	return found
+}
@@ -0,0 +1,50 @@
+package gosshacl
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilesRollover(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "rollover.*")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	keyFile := path.Join(dir, "keys")
+	_ = ioutil.WriteFile(keyFile, []byte(strings.Replace(te, "localhost:root", "localhost:admin", 1)), 0600)
+	_ = ioutil.WriteFile(keyFile+rolloverExtension, []byte(te), 0600)
+	files := &Files{KeyFile: keyFile}
+	if err := files.FindEntry(new(bytes.Buffer), "localhost", NewQuery("root", tkh)); err != ErrNotFound {
+		t.Errorf("rollover searched without window: %v", err)
+	}
+	files.RolloverWindow = time.Hour
+	if err := files.FindEntry(new(bytes.Buffer), "localhost", NewQuery("root", tkh)); err != ErrNotFound {
+		t.Errorf("key removed from the current generation must not match: %v", err)
+	}
+	w := new(bytes.Buffer)
+	if err := files.FindEntry(w, "localhost", NewQuery("admin", tkh)); err != nil || w.String() != ok+"\n" {
+		t.Errorf("current generation not searched: %v %q", err, w.String())
+	}
+	_ = os.Chmod(keyFile, 0666)
+	w.Reset()
+	q := NewQuery("root", tkh)
+	q.Result = new(Result)
+	if err := files.FindEntry(w, "localhost", q); err != nil || w.String() != ok+"\n" {
+		t.Fatalf("rollover not searched in window for unreadable keyfile: %v %q", err, w.String())
+	}
+	if q.Result.Backend != BackendRollover || q.Result.Matches[0].Source != keyFile+rolloverExtension {
+		t.Errorf("wrong attribution: %s %v", q.Result.Backend, q.Result.Matches)
+	}
+	old := time.Now().Add(-time.Hour * 2)
+	_ = os.Chtimes(keyFile, old, old)
+	w.Reset()
+	if err := files.FindEntry(w, "localhost", NewQuery("root", tkh)); err == nil || w.Len() > 0 {
+		t.Errorf("rollover searched after window: %v", err)
+	}
+}
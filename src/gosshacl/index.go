@@ -0,0 +1,247 @@
+package gosshacl
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"syscall"
+
+	"github.com/aurora-is-near/sshaclsrv/src/fileperm"
+)
+
+const (
+	// IndexExtension is appended to the keyfile name to name its index.
+	IndexExtension = ".idx"
+
+	indexMagic       = "SSHACLX1"
+	indexMagicSigned = "SSHACLS1"
+	indexHeaderSize  = len(indexMagic) + 8 + 8 + 4
+	indexSlotSize    = 8
+)
+
+var (
+	// ErrIndexInvalid is returned for corrupt index files.
+	ErrIndexInvalid = errors.New("invalid index")
+	// ErrIndexStale is returned if the index does not belong to the current keyfile.
+	ErrIndexStale = errors.New("stale index")
+)
+
+// Index is a compiled keyfile, sorted by key hash and searchable without parsing all entries.
+//
+// Format (little endian):
+//
+//	"SSHACLX1" or "SSHACLS1" (signed lines) | keyfile size (uint64) | keyfile mtime (int64, ns) | count (uint32) |
+//	count * (offset (uint32), length (uint32)) | entries
+type Index struct {
+	data    []byte
+	count   int
+	entries []byte
+	signed  bool
+}
+
+// keyHash returns the key hash of an entry, or nil.
+func keyHash(line []byte, signed bool) []byte {
+	if signed {
+		_, line = splitLine(line)
+	}
+	return keyHashField(line)
+}
+
+func keyHashField(line []byte) []byte {
+	fields := bytes.SplitN(line, []byte{fieldDelim}, userFieldKeyHash+2)
+	if len(fields) <= userFieldKeyHash {
+		return nil
+	}
+	return fields[userFieldKeyHash]
+}
+
+// WriteIndex compiles the keyfile into its index, replacing the index atomically. If signed is true, the keyfile
+// contains signed lines.
+func WriteIndex(filename string, signed bool) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	if err := fileperm.PermissionCheck(f); err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	lines := make([][]byte, 0, 100)
+	b := bufio.NewReader(f)
+	for {
+		line, err := b.ReadBytes(lineDelim)
+		line = bytes.TrimSpace(line)
+		msg := line
+		if signed {
+			_, msg = splitLine(line)
+		}
+		if parseLine(msg) != nil {
+			lines = append(lines, line)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	sort.SliceStable(lines, func(i, j int) bool {
+		return bytes.Compare(keyHash(lines[i], signed), keyHash(lines[j], signed)) < 0
+	})
+	buf := new(bytes.Buffer)
+	if signed {
+		buf.WriteString(indexMagicSigned)
+	} else {
+		buf.WriteString(indexMagic)
+	}
+	_ = binary.Write(buf, binary.LittleEndian, uint64(info.Size()))
+	_ = binary.Write(buf, binary.LittleEndian, info.ModTime().UnixNano())
+	_ = binary.Write(buf, binary.LittleEndian, uint32(len(lines)))
+	var offset uint32
+	for _, line := range lines {
+		_ = binary.Write(buf, binary.LittleEndian, offset)
+		_ = binary.Write(buf, binary.LittleEndian, uint32(len(line)))
+		offset += uint32(len(line)) + 1
+	}
+	for _, line := range lines {
+		buf.Write(line)
+		buf.WriteByte(lineDelim)
+	}
+	tmp, err := ioutil.TempFile(path.Dir(filename), path.Base(filename)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	_, err = tmp.Write(buf.Bytes())
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename+IndexExtension)
+}
+
+// OpenIndex maps the index of the keyfile described by info. It returns ErrIndexStale if the index was not compiled
+// from that keyfile.
+func OpenIndex(filename string, info os.FileInfo) (*Index, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	if err := fileperm.PermissionCheck(f); err != nil {
+		return nil, err
+	}
+	indexInfo, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if indexInfo.Size() < int64(indexHeaderSize) || indexInfo.Size() > int64(^uint32(0)) {
+		return nil, ErrIndexInvalid
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(indexInfo.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	index := &Index{data: data}
+	if err := index.check(info); err != nil {
+		index.Close()
+		return nil, err
+	}
+	return index, nil
+}
+
+func (index *Index) check(info os.FileInfo) error {
+	switch string(index.data[:len(indexMagic)]) {
+	case indexMagic:
+	case indexMagicSigned:
+		index.signed = true
+	default:
+		return ErrIndexInvalid
+	}
+	header := index.data[len(indexMagic):indexHeaderSize]
+	if binary.LittleEndian.Uint64(header) != uint64(info.Size()) || int64(binary.LittleEndian.Uint64(header[8:])) != info.ModTime().UnixNano() {
+		return ErrIndexStale
+	}
+	index.count = int(binary.LittleEndian.Uint32(header[16:]))
+	entriesStart := indexHeaderSize + index.count*indexSlotSize
+	if entriesStart > len(index.data) {
+		return ErrIndexInvalid
+	}
+	index.entries = index.data[entriesStart:]
+	return nil
+}
+
+// Close unmaps the index.
+func (index *Index) Close() {
+	_ = syscall.Munmap(index.data)
+}
+
+func (index *Index) line(i int) []byte {
+	slot := index.data[indexHeaderSize+i*indexSlotSize:]
+	offset, length := binary.LittleEndian.Uint32(slot), binary.LittleEndian.Uint32(slot[4:])
+	if uint64(offset)+uint64(length) > uint64(len(index.entries)) {
+		return nil
+	}
+	return index.entries[offset : offset+length]
+}
+
+// FindEntry searches the index for keys matching the query and writes them to w, with the same results as searching
+// the keyfile itself. Nothing is written or recorded if ErrIndexInvalid is returned.
+func (index *Index) FindEntry(w io.Writer, hostname string, q *Query) error {
+	return index.findEntry(w, hostname, nil, q)
+}
+
+// findEntry searches the index. Indexes of signed lines require a verifier, other indexes must not have one.
+func (index *Index) findEntry(w io.Writer, hostname string, verifier *RemoteACL, q *Query) error {
+	if index.signed != (verifier != nil) {
+		return ErrIndexInvalid
+	}
+	fingerprint := []byte(q.Fingerprint)
+	i := sort.Search(index.count, func(i int) bool {
+		return bytes.Compare(keyHash(index.line(i), index.signed), fingerprint) >= 0
+	})
+	var found []*aclEntry
+	var signers []ed25519.PublicKey
+	for ; i < index.count; i++ {
+		line := index.line(i)
+		if line == nil {
+			return ErrIndexInvalid
+		}
+		if !bytes.Equal(keyHash(line, index.signed), fingerprint) {
+			break
+		}
+		var signer ed25519.PublicKey
+		if index.signed {
+			var ok bool
+			sig, msg := splitLine(line)
+			if signer, ok = verifier.verifyLine(sig, msg); !ok {
+				continue
+			}
+			line = msg
+		}
+		if e, ok := matchLine(line, hostname, q); ok && !q.revoked(e, signer) {
+			found = append(found, e)
+			signers = append(signers, signer)
+		}
+	}
+	if len(found) == 0 {
+		return ErrNotFound
+	}
+	for i, e := range found {
+		q.addMatch(e, signers[i])
+	}
+	return writeEntries(w, found)
+}
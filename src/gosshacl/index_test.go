@@ -0,0 +1,139 @@
+package gosshacl
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aurora-is-near/sshaclsrv/src/revocation"
+)
+
+func TestIndex(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "index.*")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	lines := []string{"# comment", strings.Replace(te, "localhost", "*", 1)}
+	for i := 0; i < 100; i++ {
+		lines = append(lines, strings.Replace(te, "RFqtJf2Q", fmt.Sprintf("%08d", i), 1))
+	}
+	lines = append(lines, te, strings.Replace(te, "root", "nobody", 1), "  "+te)
+	keyFile := path.Join(dir, "keys")
+	if err := ioutil.WriteFile(keyFile, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	queries := []*Query{NewQuery("root", tkh), NewQuery("nobody", tkh), NewQuery("root", "00000042"), NewQuery("root", "zzz"), NewQuery("root", "")}
+	expect := make([]string, len(queries))
+	for i, q := range queries {
+		w := new(bytes.Buffer)
+		_ = FindEntry(strings.NewReader(strings.Join(lines, "\n")), w, "localhost", q)
+		expect[i] = w.String()
+	}
+	if err := WriteIndex(keyFile, false); err != nil {
+		t.Fatalf("WriteIndex: %s", err)
+	}
+	info, _ := os.Stat(keyFile)
+	index, err := OpenIndex(keyFile+IndexExtension, info)
+	if err != nil {
+		t.Fatalf("OpenIndex: %s", err)
+	}
+	defer index.Close()
+	for i, q := range queries {
+		w := new(bytes.Buffer)
+		_ = index.FindEntry(w, "localhost", q)
+		if w.String() != expect[i] {
+			t.Errorf("query %d: index returned %q, keyfile %q", i, w.String(), expect[i])
+		}
+		w.Reset()
+		_ = FindEntryFromFile(keyFile, w, "localhost", q)
+		if w.String() != expect[i] {
+			t.Errorf("query %d: FindEntryFromFile returned %q, keyfile %q", i, w.String(), expect[i])
+		}
+	}
+	later := info.ModTime().Add(time.Second)
+	_ = os.Chtimes(keyFile, later, later)
+	info, _ = os.Stat(keyFile)
+	if _, err := OpenIndex(keyFile+IndexExtension, info); err != ErrIndexStale {
+		t.Errorf("modified keyfile must make index stale: %v", err)
+	}
+}
+
+func TestSignedKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "index.*")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	masterPub, entry := testSignedEntry()
+	forged := entry[:strings.IndexByte(entry, ':')+1] + strings.Replace(te, "root", "admin", 1)
+	keyFile := path.Join(dir, "keys")
+	if err := ioutil.WriteFile(keyFile, []byte(strings.Join([]string{te, forged, entry}, "\n")), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	for _, indexed := range []bool{false, true} {
+		if indexed {
+			if err := WriteIndex(keyFile, true); err != nil {
+				t.Fatalf("WriteIndex: %s", err)
+			}
+		}
+		w := new(bytes.Buffer)
+		q := NewQuery("root", tkh)
+		q.Result = new(Result)
+		if err := FindSignedEntryFromFile(keyFile, w, "localhost", masterPub, q); err != nil {
+			t.Fatalf("FindSignedEntryFromFile (indexed %t): %s", indexed, err)
+		}
+		if strings.TrimSpace(w.String()) != ok || len(q.Result.Matches) != 1 || q.Result.Matches[0].Signer == nil {
+			t.Errorf("wrong result (indexed %t): %q", indexed, w.String())
+		}
+		if err := FindSignedEntryFromFile(keyFile, new(bytes.Buffer), "localhost", masterPub, NewQuery("admin", tkh)); err != ErrNotFound {
+			t.Errorf("forged entry accepted (indexed %t): %v", indexed, err)
+		}
+		otherPub, _ := testSignedEntry()
+		if err := FindSignedEntryFromFile(keyFile, new(bytes.Buffer), "localhost", otherPub, NewQuery("root", tkh)); err != ErrNotFound {
+			t.Errorf("entry signed by other key accepted (indexed %t): %v", indexed, err)
+		}
+	}
+}
+
+func TestSignedKeyFileRevocations(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "index.*")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	masterPub, entry := testSignedEntry()
+	keyFile := path.Join(dir, "keys")
+	if err := ioutil.WriteFile(keyFile, []byte(entry), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	q := NewQuery("root", tkh)
+	q.Result = new(Result)
+	if err := FindSignedEntryFromFile(keyFile, new(bytes.Buffer), "localhost", masterPub, q); err != nil {
+		t.Fatalf("FindSignedEntryFromFile: %s", err)
+	}
+	signer := q.Result.Matches[0].Signer
+	for _, indexed := range []bool{false, true} {
+		if indexed {
+			if err := WriteIndex(keyFile, true); err != nil {
+				t.Fatalf("WriteIndex: %s", err)
+			}
+		}
+		q := NewQuery("root", tkh)
+		q.Revocations = revocation.New(1, time.Now())
+		q.Revocations.AddKey(tkh, "")
+		if err := FindSignedEntryFromFile(keyFile, new(bytes.Buffer), "localhost", masterPub, q); err != ErrNotFound {
+			t.Errorf("revoked key accepted (indexed %t): %v", indexed, err)
+		}
+		q.Revocations = revocation.New(1, time.Now())
+		q.Revocations.AddSubkey(signer)
+		if err := FindSignedEntryFromFile(keyFile, new(bytes.Buffer), "localhost", masterPub, q); err != ErrNotFound {
+			t.Errorf("entry signed by revoked subkey accepted (indexed %t): %v", indexed, err)
+		}
+	}
+}
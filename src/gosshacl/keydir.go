@@ -0,0 +1,54 @@
+package gosshacl
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/aurora-is-near/sshaclsrv/src/fileperm"
+)
+
+const (
+	// FragmentExtension is the extension of keyfile fragments in a keyfile directory.
+	FragmentExtension = ".keys"
+)
+
+// Fragments returns the keyfile fragments in dir in lexical order. A missing directory contains no fragments.
+func Fragments(dir string) ([]string, error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer func() { _ = d.Close() }()
+	if err := fileperm.DirPermissionCheck(d); err != nil {
+		return nil, err
+	}
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]string, 0, len(names))
+	for _, name := range names {
+		if strings.HasSuffix(name, FragmentExtension) && name[0] != '.' {
+			ret = append(ret, path.Join(dir, name))
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func openFragment(filename string) (*AuthorizedFile, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := fileperm.PermissionCheck(f); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return (*AuthorizedFile)(f), nil
+}
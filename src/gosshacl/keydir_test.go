@@ -0,0 +1,65 @@
+package gosshacl
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestFindEntryFromFiles(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "keydir.*")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	keyDir := path.Join(dir, "keyfile.d")
+	_ = os.Mkdir(keyDir, 0700)
+	other := strings.Replace(te, "localhost:root", "localhost:admin", 1)
+	files := map[string]string{
+		"20-b.keys":    te,
+		"10-a.keys":    strings.Replace(te, ":ecdsa", ":no-pty ecdsa", 1),
+		"30-c.keys":    other,
+		"40-d.keys":    te,
+		"ignored.conf": te,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(path.Join(keyDir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+	}
+	_ = os.Chmod(path.Join(keyDir, "40-d.keys"), 0666)
+	log := new(bytes.Buffer)
+	ErrorLog.SetOutput(log)
+	defer ErrorLog.SetOutput(os.Stderr)
+	keyFile := path.Join(dir, "keys")
+	w := new(bytes.Buffer)
+	q := NewQuery("root", tkh)
+	q.Result = new(Result)
+	if err := FindEntryFromFiles(keyFile, keyDir, w, "localhost", nil, q); err != nil {
+		t.Fatalf("FindEntryFromFiles without keyfile: %s", err)
+	}
+	if w.String() != "no-pty "+ok+"\n"+ok+"\n" {
+		t.Errorf("wrong keys or order: %q", w.String())
+	}
+	if len(q.Result.Matches) != 2 || q.Result.Matches[0].Source != path.Join(keyDir, "10-a.keys") {
+		t.Errorf("wrong attribution: %v", q.Result.Matches)
+	}
+	if !strings.Contains(log.String(), "40-d.keys") {
+		t.Error("writeable fragment not reported")
+	}
+	_ = ioutil.WriteFile(keyFile, []byte(te), 0600)
+	w.Reset()
+	if err := FindEntryFromFiles(keyFile, keyDir, w, "localhost", nil, NewQuery("admin", tkh)); err != nil || w.String() != ok+"\n" {
+		t.Errorf("fragment entry not found: %v %q", err, w.String())
+	}
+	if err := FindEntryFromFiles(keyFile, keyDir, new(bytes.Buffer), "localhost", nil, NewQuery("nobody", tkh)); err != ErrNotFound {
+		t.Errorf("must return ErrNotFound: %v", err)
+	}
+	_ = os.Remove(keyFile)
+	if err := FindEntryFromFiles(keyFile, keyDir, new(bytes.Buffer), "localhost", nil, NewQuery("nobody", tkh)); !os.IsNotExist(err) {
+		t.Errorf("missing keyfile must be reported if nothing matches: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package gosshacl
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/aurora-is-near/sshaclsrv/src/constants"
+
+	"github.com/aurora-is-near/sshaclsrv/src/revocation"
+
+	"github.com/aurora-is-near/sshaclsrv/src/sshkey"
+)
+
+var (
+	// ErrKeyMismatch is returned if the presented key does not match the fingerprint.
+	ErrKeyMismatch = errors.New("presented key does not match fingerprint")
+	// ErrInvalidKeyID is returned for certificate key IDs that cannot be looked up.
+	ErrInvalidKeyID = errors.New("invalid certificate key ID")
+	// ErrInvalidConnection is returned if the connection endpoints cannot be parsed.
+	ErrInvalidConnection = errors.New("invalid connection endpoints")
+)
+
+// Query describes a login attempt for which to look up keys.
+type Query struct {
+	User          string      // System user to authenticate as.
+	Fingerprint   string      // SHA256 fingerprint of the presented key, without "SHA256:" prefix.
+	KeyID         string      // Key ID of the presented certificate, for principal lookups.
+	Key           *sshkey.Key // Presented key. Optional, if set only entries containing the same key match.
+	ClientAddress net.IP      // Address of the client. Optional, if set entries restricted to other networks do not match.
+	Aliases       []string    // Further names of the host, like its addresses. Optional, entries for them match too.
+	Result        *Result     // Optional, receives details about how the query was answered.
+
+	// Revocations are keys and delegated subkeys that never match. Optional.
+	Revocations *revocation.List
+
+	source           string // File that is being searched, for attribution.
+	ignoreConditions bool   // Match entries regardless of client address and access windows.
+}
+
+// NewQuery returns a query for user and the fingerprint of the presented key (as given by sshd's %f).
+func NewQuery(user, fingerprint string) *Query {
+	fingerprint = splitKey(fingerprint)
+	if strings.HasPrefix(fingerprint, constants.KeyIDPrefix) {
+		fingerprint = ""
+	}
+	return &Query{
+		User:        user,
+		Fingerprint: fingerprint,
+	}
+}
+
+// SetKey sets the presented key from its type and base64 encoding (as given by sshd's %t and %k). If the query has
+// no fingerprint, it is calculated from the key.
+func (q *Query) SetKey(keyType, key string) error {
+	k, err := sshkey.ParseKey(keyType + " " + key)
+	if err != nil {
+		return err
+	}
+	if q.Fingerprint == "" {
+		q.Fingerprint = k.Fingerprint
+	} else if q.Fingerprint != k.Fingerprint {
+		return ErrKeyMismatch
+	}
+	q.Key = k
+	return nil
+}
+
+// SetConnection sets the client address from the connection endpoints (as given by sshd's %C): client address, client
+// port, server address and server port, separated by spaces.
+func (q *Query) SetConnection(endpoints string) error {
+	f := strings.Fields(endpoints)
+	if len(f) == 0 {
+		return ErrInvalidConnection
+	}
+	ip := net.ParseIP(f[0])
+	if ip == nil {
+		return ErrInvalidConnection
+	}
+	q.ClientAddress = ip
+	return nil
+}
+
+// revoked returns true if the entry's key, or the delegated key that signed it, is revoked.
+func (q *Query) revoked(e *aclEntry, signer ed25519.PublicKey) bool {
+	return q.Revocations.KeyRevoked(e.KeyHash) || (signer != nil && q.Revocations.SubkeyRevoked(signer))
+}
+
+// unconditional returns a copy of q that matches entries regardless of their conditions.
+func (q *Query) unconditional() *Query {
+	c := *q
+	c.Result, c.ignoreConditions = nil, true
+	return &c
+}
+
+// NewPrincipalQuery returns a query for the principals that user may log in with, using a certificate with keyID (as
+// given by sshd's %i).
+func NewPrincipalQuery(user, keyID string) (*Query, error) {
+	if keyID == "" || keyID[0] == '.' || strings.ContainsAny(keyID, "/\\: \t\n") {
+		return nil, ErrInvalidKeyID
+	}
+	return &Query{
+		User:        user,
+		Fingerprint: constants.KeyIDPrefix + keyID,
+		KeyID:       keyID,
+	}, nil
+}
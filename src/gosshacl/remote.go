@@ -3,24 +3,39 @@ package gosshacl
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/ed25519"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/aurora-is-near/sshaclsrv/src/manifest"
+
 	"github.com/aurora-is-near/sshaclsrv/src/constants"
 
+	"github.com/aurora-is-near/sshaclsrv/src/revocation"
+
 	"github.com/aurora-is-near/sshaclsrv/src/delegatesign"
 )
 
 var (
 	// ErrFallback is returned if processing should continue with a different backend.
 	ErrFallback = errors.New("fallback")
+	// ErrNoManifest is returned if a fetched keyfile requires but lacks a valid manifest.
+	ErrNoManifest = errors.New("missing or invalid manifest")
+	// ErrRollback is returned if a fetched keyfile is older than the last accepted one.
+	ErrRollback = errors.New("keyfile older than last accepted serial")
+)
+
+const (
+	defaultTimeout = time.Second * 5
 )
 
 // RemoteACL calls a remote HTTP(s) server to find keys.
@@ -29,6 +44,16 @@ type RemoteACL struct {
 	PublicKey ed25519.PublicKey // Master Publickey.
 	Token     string            // http-basic auth password, hostname is user.
 	Hostname  string            // Server's hostname.
+	Timeout   time.Duration     // Timeout of a single request, defaults to 5 seconds.
+	Cache     *Cache            // Optional cache to store verified responses to.
+	Signed    bool              // Fetch writes lines including their signatures.
+	TLSConfig *tls.Config       // TLS configuration, system defaults if nil.
+	Aliases   []string          // Further names of the server, like its addresses, to look up after Hostname.
+
+	Revocations *revocation.List // Fetch leaves out lines for revoked keys and key IDs, and lines signed by revoked subkeys.
+
+	RequireManifest bool   // Refuse fetched keyfiles without manifest.
+	MinSerial       uint64 // Refuse fetched keyfiles with lower manifest serial. Implies RequireManifest if not zero.
 }
 
 // NewRemote returns a new RemoteACL that uses the given url. If token is not empty it will
@@ -52,8 +77,10 @@ func minDuration(a, b time.Duration) time.Duration {
 	return b
 }
 
-func httpclient(timeout time.Duration) *http.Client {
-	timeout = minDuration(time.Second*5, timeout)
+func httpclient(timeout time.Duration, tlsConfig *tls.Config) *http.Client {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
 	return &http.Client{
 		Timeout: timeout,
 		Transport: &http.Transport{
@@ -65,17 +92,18 @@ func httpclient(timeout time.Duration) *http.Client {
 				Timeout:   timeout,
 				KeepAlive: timeout,
 			}).DialContext,
+			TLSClientConfig:       tlsConfig,
 			ForceAttemptHTTP2:     true,
 			MaxIdleConns:          10,
 			IdleConnTimeout:       timeout,
-			TLSHandshakeTimeout:   minDuration(time.Second, timeout-time.Second),
-			ExpectContinueTimeout: minDuration(time.Second, timeout-time.Second*2),
+			TLSHandshakeTimeout:   minDuration(time.Second, timeout/2),
+			ExpectContinueTimeout: minDuration(time.Second, timeout/2),
 		},
 	}
 }
 
-func getURL(c *http.Client, url, hostname, token string) (*http.Response, error) {
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+func getURL(ctx context.Context, c *http.Client, url, hostname, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, ErrFallback
 	}
@@ -87,31 +115,178 @@ func getURL(c *http.Client, url, hostname, token string) (*http.Response, error)
 	if err != nil {
 		return nil, ErrFallback
 	}
-	if resp.StatusCode == http.StatusNotFound {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusNotFound:
+		_ = resp.Body.Close()
 		return nil, ErrNotFound
+	default:
+		_ = resp.Body.Close()
+		return nil, ErrFallback
 	}
-	return resp, nil
 }
 
-// FindEntry calls the remote backend to find matching keys and writes them to w.
-func (remote *RemoteACL) FindEntry(w io.Writer, username, fingerprint string) error {
-	fingerprint = splitKey(fingerprint)
-	url := strings.Join([]string{remote.URL, constants.PerKeyPath, fingerprint, remote.Hostname, username}, "/")
-	resp, err := getURL(httpclient(0), url, remote.Hostname, remote.Token)
+// FindEntry calls the remote backend to find keys matching the query and writes them to w. The aliases are only
+// requested while no keys were found for the names before them.
+func (remote *RemoteACL) FindEntry(w io.Writer, q *Query) error {
+	return remote.findEntry(context.Background(), w, q)
+}
+
+func (remote *RemoteACL) findEntry(ctx context.Context, w io.Writer, q *Query) error {
+	q.begin(BackendRemote, remote.URL)
+	var signed *bytes.Buffer
+	if remote.Cache != nil {
+		signed = new(bytes.Buffer)
+	}
+	found := false
+	for _, name := range remote.names() {
+		url := strings.Join([]string{remote.URL, constants.PerKeyPath, q.Fingerprint, name, q.User}, "/")
+		resp, err := getURL(ctx, httpclient(remote.Timeout, remote.TLSConfig), url, remote.Hostname, remote.Token)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if signed == nil {
+			err = remote.parseResponse(w, resp.Body, q, false)
+		} else {
+			err = remote.parseSigned(w, signed, resp.Body, q, false)
+		}
+		_ = resp.Body.Close()
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// Keys for the first name suffice, the remaining aliases are not requested.
+		found = true
+		break
+	}
+	if signed != nil {
+		remote.Cache.store(q, signed.Bytes())
+	}
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// names returns the hostname and the aliases that can be part of a URL.
+func (remote *RemoteACL) names() []string {
+	ret := []string{remote.Hostname}
+	for _, alias := range remote.Aliases {
+		if alias != remote.Hostname && !strings.ContainsAny(alias, "/:") {
+			ret = append(ret, alias)
+		}
+	}
+	return ret
+}
+
+// Fetch calls the remote backend to find keys for the host and its aliases and writes them to w. Errors of aliases are
+// ignored once keys were found for a name before them.
+func (remote *RemoteACL) Fetch(w io.Writer) error {
+	return remote.fetch(context.Background(), w)
+}
+
+func (remote *RemoteACL) fetch(ctx context.Context, w io.Writer) error {
+	found := false
+	for _, name := range remote.names() {
+		switch err := remote.fetchName(ctx, w, name); err {
+		case nil:
+			found = true
+		case ErrNotFound:
+		default:
+			if found {
+				// The names before returned keys, a failing alias only lacks its additional entries.
+				continue
+			}
+			return err
+		}
+	}
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// fetchName writes the keys the remote backend returns for name to w.
+func (remote *RemoteACL) fetchName(ctx context.Context, w io.Writer, name string) error {
+	url := strings.Join([]string{remote.URL, constants.PerHostPath, name}, "/")
+	resp, err := getURL(ctx, httpclient(remote.Timeout, remote.TLSConfig), url, remote.Hostname, remote.Token)
 	if err != nil {
 		return err
 	}
-	return remote.parseResponse(w, resp.Body, username, fingerprint, false)
+	body, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if err := remote.verifyManifest(body); err != nil {
+		return err
+	}
+	return remote.parseResponse(w, bytes.NewReader(body), nil, true)
 }
 
-// Fetch calls the remote backend to find keys for the host and writes them to w.
-func (remote *RemoteACL) Fetch(w io.Writer) error {
-	url := strings.Join([]string{remote.URL, constants.PerHostPath, remote.Hostname}, "/")
-	resp, err := getURL(httpclient(0), url, remote.Hostname, remote.Token)
+// FetchRevocations calls the remote backend for the revocation list and writes it to w after verifying its
+// signature.
+func (remote *RemoteACL) FetchRevocations(w io.Writer) error {
+	return remote.fetchRevocations(context.Background(), w)
+}
+
+func (remote *RemoteACL) fetchRevocations(ctx context.Context, w io.Writer) error {
+	url := strings.Join([]string{remote.URL, constants.RevocationPath}, "/")
+	resp, err := getURL(ctx, httpclient(remote.Timeout, remote.TLSConfig), url, remote.Hostname, remote.Token)
 	if err != nil {
 		return err
 	}
-	return remote.parseResponse(w, resp.Body, "", "", true)
+	defer func() { _ = resp.Body.Close() }()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if _, err := revocation.Parse(body, remote.PublicKey); err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+// verifyManifest verifies that the signed manifest in body covers all other lines, and that the serial is not lower
+// than MinSerial. A missing manifest is only accepted if neither RequireManifest nor MinSerial are set.
+func (remote *RemoteACL) verifyManifest(body []byte) error {
+	var m *manifest.Manifest
+	summer := manifest.NewSummer()
+	for _, line := range bytes.Split(body, []byte{lineDelim}) {
+		line = bytes.TrimRight(line, "\r")
+		if len(line) == 0 {
+			continue
+		}
+		sig, msg := splitLine(line)
+		if !manifest.IsManifest(msg) {
+			summer.Add(line)
+			continue
+		}
+		if _, ok := remote.verifyLine(sig, msg); m != nil || !ok {
+			return ErrNoManifest
+		}
+		var err error
+		if m, err = manifest.Parse(msg); err != nil {
+			return ErrNoManifest
+		}
+	}
+	if m == nil {
+		if remote.RequireManifest || remote.MinSerial > 0 {
+			return ErrNoManifest
+		}
+		return nil
+	}
+	if m.Serial < remote.MinSerial {
+		return ErrRollback
+	}
+	return summer.Verify(m)
 }
 
 func splitLine(line []byte) (sig, msg []byte) {
@@ -122,39 +297,63 @@ func splitLine(line []byte) (sig, msg []byte) {
 	return line[:p], line[p+1:]
 }
 
-func (remote *RemoteACL) verifyLine(sig, msg []byte) bool {
+// verifyLine verifies the signature of msg and returns the delegated key that signed it.
+func (remote *RemoteACL) verifyLine(sig, msg []byte) (ed25519.PublicKey, bool) {
 	out := make([]byte, delegatesign.DelegatedSignatureLength)
 	if _, err := base64.StdEncoding.Decode(out, sig); err != nil {
-		return false
+		return nil, false
 	}
-	_, ok := (delegatesign.DelegatedSignature)(out).Verify(remote.PublicKey, msg)
-	return ok
+	return (delegatesign.DelegatedSignature)(out).Verify(remote.PublicKey, msg)
 }
 
-func (remote *RemoteACL) parseResponse(w io.Writer, r io.Reader, user, fingerprint string, dontMatch bool) error {
+func (remote *RemoteACL) parseResponse(w io.Writer, r io.Reader, q *Query, dontMatch bool) error {
+	return remote.parseSigned(w, nil, r, q, dontMatch)
+}
+
+// parseSigned verifies and matches the lines read from r and writes the results to w. If signed is not nil, all
+// verified lines that match regardless of their conditions are written to it including their signatures.
+func (remote *RemoteACL) parseSigned(w, signed io.Writer, r io.Reader, q *Query, dontMatch bool) error {
 	var found bool
 	buf := bufio.NewReader(r)
 	for {
 		line, err := buf.ReadBytes(lineDelim)
+		line = bytes.TrimRight(line, "\r\n")
 		if len(line) > 0 {
 			sig, msg := splitLine(line)
 			if sig == nil || len(sig) == 0 || msg == nil || len(msg) == 0 {
 				continue
 			}
-			if !remote.verifyLine(sig, msg) {
+			signer, ok := remote.verifyLine(sig, msg)
+			if !ok {
 				continue
 			}
 			if !dontMatch {
-				if e, ok := matchLine(msg, remote.Hostname, user, fingerprint); !ok {
+				e, ok := matchLine(msg, remote.Hostname, q)
+				if ok && q.revoked(e, signer) {
 					continue
-				} else {
+				}
+				if ok {
 					found = true
-					_, _ = fmt.Fprintln(w, e.AuthorizedKey)
+					q.addMatch(e, signer)
+					_, _ = fmt.Fprintln(w, e.authorizedKey())
+				} else if signed != nil {
+					_, ok = matchLine(msg, remote.Hostname, q.unconditional())
+				}
+				if ok && signed != nil {
+					_, _ = signed.Write(line)
+					_, _ = signed.Write([]byte{lineDelim})
 				}
 			} else {
+				if e := parseLine(msg); e != nil && (remote.Revocations.KeyRevoked(e.KeyHash) || remote.Revocations.SubkeyRevoked(signer)) {
+					continue
+				}
 				found = true
-				_, _ = w.Write(msg)
-				// _, _ = w.Write([]byte("\n"))
+				if remote.Signed {
+					_, _ = w.Write(line)
+				} else {
+					_, _ = w.Write(msg)
+				}
+				_, _ = w.Write([]byte{lineDelim})
 			}
 		}
 		if err == io.EOF {
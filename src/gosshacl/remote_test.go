@@ -4,12 +4,15 @@ import (
 	"bytes"
 	"crypto/ed25519"
 	"crypto/rand"
+	"encoding/base64"
 	"fmt"
 	"net/http"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/aurora-is-near/sshaclsrv/src/manifest"
+
 	"github.com/aurora-is-near/sshaclsrv/src/delegatesign"
 )
 
@@ -29,7 +32,7 @@ func TestRemoteParse(t *testing.T) {
 	buf.Write([]byte(entry))
 	remote := NewRemote("https://127.0.0.1:9100", masterPub, "", "localhost")
 	w := new(bytes.Buffer)
-	if err := remote.parseResponse(w, buf, "root", tkhc, false); err != nil {
+	if err := remote.parseResponse(w, buf, NewQuery("root", tkh), false); err != nil {
 		t.Errorf("parseResponse: %s", err)
 	}
 	if strings.TrimSpace(w.String()) != ok {
@@ -77,10 +80,67 @@ func TestRemote(t *testing.T) {
 	time.Sleep(time.Second / 2)
 	remote := NewRemote("http://127.0.0.1:9100", masterPub, "", "localhost")
 	w := new(bytes.Buffer)
-	if err := remote.FindEntry(w, "root", tkh); err != nil {
+	if err := remote.FindEntry(w, NewQuery("root", tkh)); err != nil {
 		t.Fatalf("FindEntry: %s", err)
 	}
 	if strings.TrimSpace(w.String()) != ok {
 		t.Error("wrong key")
 	}
 }
+
+func TestRemoteParseMultiline(t *testing.T) {
+	masterPub, entry := testSignedEntry()
+	buf := new(bytes.Buffer)
+	buf.WriteString(entry + "\n" + entry + "\r\n" + entry)
+	remote := NewRemote("https://127.0.0.1:9100", masterPub, "", "localhost")
+	w := new(bytes.Buffer)
+	if err := remote.parseResponse(w, buf, NewQuery("root", tkh), false); err != nil {
+		t.Errorf("parseResponse: %s", err)
+	}
+	if strings.Count(w.String(), ok) != 3 {
+		t.Errorf("not all lines verified: %q", w.String())
+	}
+}
+
+func TestRemoteManifest(t *testing.T) {
+	masterPub, masterPriv, _ := ed25519.GenerateKey(rand.Reader)
+	subPub, subPriv, _ := ed25519.GenerateKey(rand.Reader)
+	delkey := delegatesign.DelegateKey(masterPriv, subPub, time.Now().Add(time.Minute))
+	e := &aclEntry{
+		Hostname:      "localhost",
+		User:          "root",
+		KeyHash:       tkhc,
+		AuthorizedKey: tk,
+	}
+	lines := []string{e.Sign(delkey, subPriv), e.Sign(delkey, subPriv)}
+	summer := manifest.NewSummer()
+	for _, l := range lines {
+		summer.Add([]byte(l))
+	}
+	msg := summer.Manifest(100, time.Now()).String()
+	signedManifest := base64.StdEncoding.EncodeToString(delkey.Sign(subPriv, []byte(msg))) + ":" + msg
+	remote := NewRemote("https://127.0.0.1:9100", masterPub, "", "localhost")
+	body := strings.Join(append([]string{signedManifest}, lines...), "\n")
+	if err := remote.verifyManifest([]byte(body)); err != nil {
+		t.Errorf("verifyManifest: %s", err)
+	}
+	if err := remote.verifyManifest([]byte(strings.Join([]string{signedManifest, lines[0]}, "\n"))); err == nil {
+		t.Error("truncation not detected")
+	}
+	if err := remote.verifyManifest([]byte(strings.Join(lines, "\n"))); err != nil {
+		t.Errorf("missing manifest not accepted: %s", err)
+	}
+	remote.RequireManifest = true
+	if err := remote.verifyManifest([]byte(strings.Join(lines, "\n"))); err != ErrNoManifest {
+		t.Errorf("missing manifest not detected: %v", err)
+	}
+	remote.MinSerial = 101
+	if err := remote.verifyManifest([]byte(body)); err != ErrRollback {
+		t.Errorf("rollback not detected: %v", err)
+	}
+	forged := "AAAA" + signedManifest[4:]
+	remote.MinSerial = 0
+	if err := remote.verifyManifest([]byte(strings.Join(append([]string{forged}, lines...), "\n"))); err != ErrNoManifest {
+		t.Errorf("forged manifest not detected: %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package gosshacl
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"time"
+)
+
+// RemoteSet is a list of remote repositories (mirrors) that are queried in order, or concurrently, before processing
+// falls back to local lookups.
+type RemoteSet struct {
+	Remotes []*RemoteACL  // Repositories in order of preference.
+	Race    bool          // Query all repositories concurrently and use the first conclusive answer.
+	Timeout time.Duration // Time budget across all repositories. No budget if zero.
+	// Err disables the repositories, for example after an invalid TLS configuration. Lookups fall back to local
+	// processing without contacting any repository, fetches return Err.
+	Err error
+}
+
+// NewRemoteSet returns a RemoteSet for remotes.
+func NewRemoteSet(race bool, timeout time.Duration, remotes ...*RemoteACL) *RemoteSet {
+	return &RemoteSet{
+		Remotes: remotes,
+		Race:    race,
+		Timeout: timeout,
+	}
+}
+
+type remoteResult struct {
+	buf    *bytes.Buffer
+	result *Result
+	err    error
+}
+
+// conclusive returns true if the result ends the search.
+func (result remoteResult) conclusive() bool {
+	return result.err == nil || result.err == ErrNotFound
+}
+
+type remoteCall func(ctx context.Context, remote *RemoteACL, w io.Writer, result *Result) error
+
+// FindEntry queries the repositories for keys matching the query and writes them to w. ErrNotFound from any
+// repository ends the search, ErrFallback is returned if no repository gave a conclusive answer within the time budget.
+func (set *RemoteSet) FindEntry(w io.Writer, q *Query) error {
+	result, err := set.do(w, func(ctx context.Context, remote *RemoteACL, w io.Writer, result *Result) error {
+		return remote.findEntry(ctx, w, q.withResult(result))
+	})
+	if err != nil && err != ErrNotFound {
+		return ErrFallback
+	}
+	if q.Result != nil && result != nil {
+		*q.Result = *result
+	}
+	return err
+}
+
+// Fetch queries the repositories for the keys of the host and writes them to w. If no repository gave a conclusive
+// answer, the error of the last repository is returned.
+func (set *RemoteSet) Fetch(w io.Writer) error {
+	_, err := set.do(w, func(ctx context.Context, remote *RemoteACL, w io.Writer, result *Result) error {
+		return remote.fetch(ctx, w)
+	})
+	return err
+}
+
+// FetchRevocations queries the repositories for the revocation list and writes it to w. ErrNotFound from any
+// repository ends the search, otherwise the error of the last repository is returned if none gave a conclusive answer.
+func (set *RemoteSet) FetchRevocations(w io.Writer) error {
+	_, err := set.do(w, func(ctx context.Context, remote *RemoteACL, w io.Writer, result *Result) error {
+		return remote.fetchRevocations(ctx, w)
+	})
+	return err
+}
+
+func (set *RemoteSet) do(w io.Writer, call remoteCall) (*Result, error) {
+	if set.Err != nil {
+		return nil, set.Err
+	}
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if set.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, set.Timeout)
+	}
+	defer cancel()
+	var result remoteResult
+	if set.Race {
+		result = set.race(ctx, call)
+	} else {
+		result = set.ordered(ctx, call)
+	}
+	if result.err != nil {
+		return result.result, result.err
+	}
+	_, err := io.Copy(w, result.buf)
+	return result.result, err
+}
+
+func callRemote(ctx context.Context, remote *RemoteACL, call remoteCall) remoteResult {
+	buf, result := new(bytes.Buffer), new(Result)
+	err := call(ctx, remote, buf, result)
+	if ctx.Err() != nil && err != nil && err != ErrNotFound {
+		err = ErrFallback
+	}
+	return remoteResult{buf: buf, result: result, err: err}
+}
+
+func (set *RemoteSet) ordered(ctx context.Context, call remoteCall) remoteResult {
+	result := remoteResult{err: ErrFallback}
+	for _, remote := range set.Remotes {
+		if ctx.Err() != nil {
+			return remoteResult{err: ErrFallback}
+		}
+		if result = callRemote(ctx, remote, call); result.conclusive() {
+			return result
+		}
+	}
+	return result
+}
+
+func (set *RemoteSet) race(ctx context.Context, call remoteCall) remoteResult {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan remoteResult, len(set.Remotes))
+	for _, remote := range set.Remotes {
+		go func(remote *RemoteACL) {
+			results <- callRemote(ctx, remote, call)
+		}(remote)
+	}
+	result := remoteResult{err: ErrFallback}
+	for range set.Remotes {
+		if result = <-results; result.conclusive() {
+			return result
+		}
+	}
+	return result
+}
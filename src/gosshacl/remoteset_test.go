@@ -0,0 +1,304 @@
+package gosshacl
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aurora-is-near/sshaclsrv/src/constants"
+
+	"github.com/aurora-is-near/sshaclsrv/src/delegatesign"
+
+	"github.com/aurora-is-near/sshaclsrv/src/revocation"
+)
+
+func testSignedEntry() (ed25519.PublicKey, string) {
+	masterPub, masterPriv, _ := ed25519.GenerateKey(rand.Reader)
+	subPub, subPriv, _ := ed25519.GenerateKey(rand.Reader)
+	delkey := delegatesign.DelegateKey(masterPriv, subPub, time.Now().Add(time.Minute))
+	e := &aclEntry{
+		Hostname:      "localhost",
+		User:          "root",
+		KeyHash:       tkhc,
+		AuthorizedKey: tk,
+	}
+	e.NotAfter, _ = time.Parse(expireTimeFormat, "21091222030101")
+	return masterPub, e.Sign(delkey, subPriv)
+}
+
+func testServer(f func(w http.ResponseWriter, r *http.Request)) *httptest.Server {
+	return httptest.NewServer(&handler{f: f})
+}
+
+func TestRemoteSetFailover(t *testing.T) {
+	masterPub, entry := testSignedEntry()
+	down := testServer(func(w http.ResponseWriter, r *http.Request) {})
+	down.Close()
+	broken := testServer(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer broken.Close()
+	good := testServer(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(entry))
+	})
+	defer good.Close()
+	set := NewRemoteSet(false, 0,
+		NewRemote(down.URL, masterPub, "", "localhost"),
+		NewRemote(broken.URL, masterPub, "", "localhost"),
+		NewRemote(good.URL, masterPub, "", "localhost"),
+	)
+	w := new(bytes.Buffer)
+	if err := set.FindEntry(w, NewQuery("root", tkh)); err != nil {
+		t.Fatalf("FindEntry: %s", err)
+	}
+	if strings.TrimSpace(w.String()) != ok {
+		t.Error("wrong key")
+	}
+}
+
+func TestRemoteSetNotFound(t *testing.T) {
+	masterPub, entry := testSignedEntry()
+	var calls int32
+	missing := testServer(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	defer missing.Close()
+	good := testServer(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		_, _ = w.Write([]byte(entry))
+	})
+	defer good.Close()
+	set := NewRemoteSet(false, 0,
+		NewRemote(missing.URL, masterPub, "", "localhost"),
+		NewRemote(good.URL, masterPub, "", "localhost"),
+	)
+	if err := set.FindEntry(new(bytes.Buffer), NewQuery("root", tkh)); err != ErrNotFound {
+		t.Errorf("FindEntry must return ErrNotFound: %v", err)
+	}
+	if atomic.LoadInt32(&calls) != 0 {
+		t.Error("second repository queried after ErrNotFound")
+	}
+}
+
+func TestRemoteSetBudget(t *testing.T) {
+	masterPub, entry := testSignedEntry()
+	slow := testServer(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second / 2)
+		_, _ = w.Write([]byte(entry))
+	})
+	defer slow.Close()
+	for _, race := range []bool{false, true} {
+		set := NewRemoteSet(race, time.Second/4,
+			NewRemote(slow.URL, masterPub, "", "localhost"),
+			NewRemote(slow.URL, masterPub, "", "localhost"),
+		)
+		if err := set.FindEntry(new(bytes.Buffer), NewQuery("root", tkh)); err != ErrFallback {
+			t.Errorf("FindEntry (race=%t) must return ErrFallback: %v", race, err)
+		}
+	}
+}
+
+func TestRemoteSetRace(t *testing.T) {
+	masterPub, entry := testSignedEntry()
+	slow := testServer(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+		w.WriteHeader(http.StatusNotFound)
+	})
+	defer slow.Close()
+	good := testServer(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(entry))
+	})
+	defer good.Close()
+	set := NewRemoteSet(true, 0,
+		NewRemote(slow.URL, masterPub, "", "localhost"),
+		NewRemote(good.URL, masterPub, "", "localhost"),
+	)
+	w := new(bytes.Buffer)
+	if err := set.FindEntry(w, NewQuery("root", tkh)); err != nil {
+		t.Fatalf("FindEntry: %s", err)
+	}
+	if strings.TrimSpace(w.String()) != ok {
+		t.Error("wrong key")
+	}
+}
+
+func TestRemoteSetRevocations(t *testing.T) {
+	masterPub, masterPriv, _ := ed25519.GenerateKey(rand.Reader)
+	list := revocation.New(1, time.Now())
+	list.AddKey(tkh, "root")
+	signed := list.Sign(masterPriv)
+	tampered := testServer(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(bytes.Replace(signed, []byte("root"), []byte("toor"), 1))
+	})
+	defer tampered.Close()
+	good := testServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+constants.RevocationPath {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(signed)
+	})
+	defer good.Close()
+	w := new(bytes.Buffer)
+	if err := NewRemoteSet(false, 0, NewRemote(tampered.URL, masterPub, "", "localhost")).FetchRevocations(w); err != revocation.ErrSignature {
+		t.Errorf("tampered list accepted: %v", err)
+	}
+	set := NewRemoteSet(false, 0,
+		NewRemote(tampered.URL, masterPub, "", "localhost"),
+		NewRemote(good.URL, masterPub, "", "localhost"),
+	)
+	w.Reset()
+	if err := set.FetchRevocations(w); err != nil || !bytes.Equal(w.Bytes(), signed) {
+		t.Fatalf("FetchRevocations: %v", err)
+	}
+	masterPub, entry := testSignedEntry()
+	remote := testServer(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(entry))
+	})
+	defer remote.Close()
+	q := NewQuery("root", tkh)
+	q.Revocations = list
+	if err := NewRemote(remote.URL, masterPub, "", "localhost").FindEntry(new(bytes.Buffer), q); err != ErrNotFound {
+		t.Errorf("revoked key returned by remote: %v", err)
+	}
+}
+
+func TestFetchRevocations(t *testing.T) {
+	masterPub, masterPriv, _ := ed25519.GenerateKey(rand.Reader)
+	var lines []string
+	var revoked ed25519.PublicKey
+	for _, user := range []string{"root", "admin"} {
+		subPub, subPriv, _ := ed25519.GenerateKey(rand.Reader)
+		delkey := delegatesign.DelegateKey(masterPriv, subPub, time.Now().Add(time.Minute))
+		e := &aclEntry{Hostname: "localhost", User: user, KeyHash: tkhc, AuthorizedKey: tk}
+		lines = append(lines, e.Sign(delkey, subPriv))
+		if revoked == nil {
+			revoked = subPub
+		}
+	}
+	srv := testServer(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(strings.Join(lines, "\n")))
+	})
+	defer srv.Close()
+	list := revocation.New(1, time.Now())
+	list.AddSubkey(revoked)
+	remote := NewRemote(srv.URL, masterPub, "", "localhost")
+	remote.Revocations = list
+	keyfile := new(bytes.Buffer)
+	if err := remote.Fetch(keyfile); err != nil {
+		t.Fatalf("Fetch: %s", err)
+	}
+	for user, expect := range map[string]error{"root": ErrNotFound, "admin": nil} {
+		q := NewQuery(user, tkh)
+		q.Revocations = list
+		if err := FindEntry(bytes.NewReader(keyfile.Bytes()), new(bytes.Buffer), "localhost", q); err != expect {
+			t.Errorf("%s: lookup in unsigned keyfile returned %v, expected %v", user, err, expect)
+		}
+	}
+}
+
+func TestRemoteAliases(t *testing.T) {
+	masterPub, masterPriv, _ := ed25519.GenerateKey(rand.Reader)
+	subPub, subPriv, _ := ed25519.GenerateKey(rand.Reader)
+	delkey := delegatesign.DelegateKey(masterPriv, subPub, time.Now().Add(time.Minute))
+	e := &aclEntry{
+		Hostname:      "10.20.0.0/16",
+		User:          "root",
+		KeyHash:       tkhc,
+		AuthorizedKey: tk,
+	}
+	entry := e.Sign(delkey, subPriv)
+	var paths []string
+	srv := testServer(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if !strings.Contains(r.URL.Path, "/10.20.1.5") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(entry))
+	})
+	defer srv.Close()
+	remote := NewRemote(srv.URL, masterPub, "", "alpha.node.com")
+	q := NewQuery("root", tkh)
+	if err := remote.FindEntry(new(bytes.Buffer), q); err != ErrNotFound {
+		t.Errorf("entry for alias found without alias: %v", err)
+	}
+	remote.Aliases = []string{"10.20.1.5", "2001:db8::5"}
+	q.Aliases = remote.Aliases
+	paths = nil
+	w := new(bytes.Buffer)
+	if err := remote.FindEntry(w, q); err != nil || strings.TrimSpace(w.String()) != ok {
+		t.Errorf("FindEntry: %v %q", err, w.String())
+	}
+	if len(paths) != 2 {
+		t.Errorf("wrong requests: %v", paths)
+	}
+	w.Reset()
+	if err := remote.Fetch(w); err != nil || strings.TrimSpace(w.String()) != "10.20.0.0/16:root:"+tkhc+"::"+tk {
+		t.Errorf("Fetch: %v %q", err, w.String())
+	}
+	hostEntry := (&aclEntry{Hostname: "alpha.node.com", User: "root", KeyHash: tkhc, AuthorizedKey: tk}).Sign(delkey, subPriv)
+	srv2 := testServer(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if !strings.Contains(r.URL.Path, "/alpha.node.com") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(hostEntry))
+	})
+	defer srv2.Close()
+	remote = NewRemote(srv2.URL, masterPub, "", "alpha.node.com")
+	remote.Aliases = []string{"10.20.1.5"}
+	paths = nil
+	if err := remote.FindEntry(new(bytes.Buffer), NewQuery("root", tkh)); err != nil || len(paths) != 1 {
+		t.Errorf("aliases requested after hostname matched: %v %v", err, paths)
+	}
+	w.Reset()
+	if err := remote.Fetch(w); err != nil || strings.TrimSpace(w.String()) != "alpha.node.com:root:"+tkhc+"::"+tk {
+		t.Errorf("failing alias after hostname: %v %q", err, w.String())
+	}
+}
+
+func TestRemoteSetDisabled(t *testing.T) {
+	dir := t.TempDir()
+	masterPub, entry := testSignedEntry()
+	var calls int32
+	server := testServer(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		_, _ = w.Write([]byte(entry))
+	})
+	defer server.Close()
+	cache := NewCache(dir, masterPub, "localhost", time.Hour, time.Minute)
+	remote := NewRemote(server.URL, masterPub, "", "localhost")
+	remote.Cache = cache
+	set := NewRemoteSet(false, 0, remote)
+	if err := set.FindEntry(new(bytes.Buffer), NewQuery("root", tkh)); err != nil {
+		t.Fatalf("FindEntry: %s", err)
+	}
+	_, set.Err = (&TLSSettings{CAFile: dir + "/missing.pem"}).Config()
+	if set.Err == nil {
+		t.Fatal("missing CA bundle must fail")
+	}
+	if err := set.FindEntry(new(bytes.Buffer), NewQuery("root", tkh)); err != ErrFallback {
+		t.Errorf("disabled set must return ErrFallback: %v", err)
+	}
+	if err := set.Fetch(new(bytes.Buffer)); err != set.Err {
+		t.Errorf("disabled set must return its error: %v", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("disabled set contacted the repository: %d", n)
+	}
+	w := new(bytes.Buffer)
+	if err := cache.FindEntry(w, NewQuery("root", tkh)); err != nil {
+		t.Fatalf("Cache.FindEntry: %s", err)
+	}
+	if strings.TrimSpace(w.String()) != ok {
+		t.Error("wrong key")
+	}
+}
@@ -0,0 +1,65 @@
+package gosshacl
+
+import (
+	"crypto/ed25519"
+	"time"
+)
+
+// Backends that can answer a query.
+const (
+	BackendRemote   = "remote"
+	BackendCache    = "cache"
+	BackendLocal    = "local"
+	BackendRollover = "rollover"
+)
+
+// Match describes an entry that matched a query.
+type Match struct {
+	NotAfter time.Time         // Expiry of the entry, zero if it does not expire.
+	Signer   ed25519.PublicKey // Delegated key that signed the entry, nil for unsigned entries.
+	Source   string            // File that contained the entry, empty for remote entries.
+	Windows  []string          // Access windows of the entry.
+}
+
+// Result describes how a query was answered.
+type Result struct {
+	Backend string  // Backend that answered the query.
+	Source  string  // URL or file that answered the query.
+	Matches []Match // Matching entries.
+}
+
+// begin resets the result of q, if any, for a lookup in backend.
+func (q *Query) begin(backend, source string) {
+	if q.Result == nil {
+		return
+	}
+	q.Result.Backend = backend
+	q.Result.Source = source
+	q.Result.Matches = nil
+}
+
+// setBackend changes the backend recorded in the result of q, if any.
+func (q *Query) setBackend(backend string) {
+	if q.Result != nil {
+		q.Result.Backend = backend
+	}
+}
+
+// addMatch records e in the result of q, if any.
+func (q *Query) addMatch(e *aclEntry, signer ed25519.PublicKey) {
+	if q.Result == nil {
+		return
+	}
+	m := Match{NotAfter: e.NotAfter, Signer: signer, Source: q.source}
+	for _, w := range e.Windows {
+		m.Windows = append(m.Windows, w.String())
+	}
+	q.Result.Matches = append(q.Result.Matches, m)
+}
+
+// withResult returns a copy of q that records into result.
+func (q *Query) withResult(result *Result) *Query {
+	c := *q
+	c.Result = result
+	return &c
+}
@@ -0,0 +1,102 @@
+package gosshacl
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/aurora-is-near/sshaclsrv/src/fileperm"
+)
+
+var (
+	// ErrNoCertificates is returned if a CA bundle contains no certificates.
+	ErrNoCertificates = errors.New("no certificates found in CA bundle")
+	// ErrPinMismatch is returned if the certificate chain of a server contains none of the pinned keys.
+	ErrPinMismatch = errors.New("no pinned key in server certificate chain")
+	// ErrClientCertificate is returned if only one of client certificate and key is given.
+	ErrClientCertificate = errors.New("client certificate requires both certificate and key")
+)
+
+// TLSSettings configure the trust of remote repositories.
+type TLSSettings struct {
+	CAFile   string   // PEM bundle of trusted CAs. System roots are used if empty.
+	Pins     []string // Base64 SHA256 hashes of SubjectPublicKeyInfo, one must be in the verified chain.
+	CertFile string   // PEM client certificate for mutual TLS.
+	KeyFile  string   // PEM client key for mutual TLS, must pass fileperm.PermissionCheck.
+}
+
+// Config returns a tls.Config for the settings, or nil if no settings are made.
+func (settings *TLSSettings) Config() (*tls.Config, error) {
+	if settings == nil || (settings.CAFile == "" && len(settings.Pins) == 0 && settings.CertFile == "" && settings.KeyFile == "") {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if settings.CAFile != "" {
+		d, err := ioutil.ReadFile(settings.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(d) {
+			return nil, ErrNoCertificates
+		}
+	}
+	if settings.CertFile != "" || settings.KeyFile != "" {
+		if settings.CertFile == "" || settings.KeyFile == "" {
+			return nil, ErrClientCertificate
+		}
+		key, err := readPrivate(settings.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := ioutil.ReadFile(settings.CertFile)
+		if err != nil {
+			return nil, err
+		}
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	if len(settings.Pins) > 0 {
+		pins := make(map[string]bool, len(settings.Pins))
+		for _, pin := range settings.Pins {
+			pins[strings.TrimPrefix(pin, "sha256/")] = true
+		}
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, chain := range state.VerifiedChains {
+				for _, cert := range chain {
+					if pins[SPKIHash(cert)] {
+						return nil
+					}
+				}
+			}
+			return ErrPinMismatch
+		}
+	}
+	return config, nil
+}
+
+// SPKIHash returns the base64 encoded SHA256 hash of the certificate's SubjectPublicKeyInfo, as used for pins.
+func SPKIHash(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func readPrivate(filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	if err := fileperm.PermissionCheck(f); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(f)
+}
@@ -0,0 +1,60 @@
+package gosshacl
+
+import (
+	"bytes"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestTLSSettings(t *testing.T) {
+	masterPub, entry := testSignedEntry()
+	server := httptest.NewTLSServer(&handler{f: func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(entry))
+	}})
+	defer server.Close()
+	dir, err := ioutil.TempDir(os.TempDir(), "tls.*")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	caFile := path.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	remote := NewRemote(server.URL, masterPub, "", "localhost")
+	if err := remote.FindEntry(new(bytes.Buffer), NewQuery("root", tkh)); err != ErrFallback {
+		t.Errorf("unknown CA must return ErrFallback: %v", err)
+	}
+	if remote.TLSConfig, err = (&TLSSettings{CAFile: caFile}).Config(); err != nil {
+		t.Fatalf("Config: %s", err)
+	}
+	if err := remote.FindEntry(new(bytes.Buffer), NewQuery("root", tkh)); err != nil {
+		t.Errorf("FindEntry with CA: %s", err)
+	}
+	pinned := &TLSSettings{CAFile: caFile, Pins: []string{SPKIHash(server.Certificate())}}
+	if remote.TLSConfig, err = pinned.Config(); err != nil {
+		t.Fatalf("Config: %s", err)
+	}
+	if err := remote.FindEntry(new(bytes.Buffer), NewQuery("root", tkh)); err != nil {
+		t.Errorf("FindEntry with pin: %s", err)
+	}
+	pinned.Pins = []string{"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}
+	if remote.TLSConfig, err = pinned.Config(); err != nil {
+		t.Fatalf("Config: %s", err)
+	}
+	if err := remote.FindEntry(new(bytes.Buffer), NewQuery("root", tkh)); err != ErrFallback {
+		t.Errorf("wrong pin must return ErrFallback: %v", err)
+	}
+	if _, err := (&TLSSettings{CertFile: caFile}).Config(); err != ErrClientCertificate {
+		t.Errorf("certificate without key must fail: %v", err)
+	}
+	if config, err := (*TLSSettings)(nil).Config(); config != nil || err != nil {
+		t.Error("nil settings must return nil config")
+	}
+}
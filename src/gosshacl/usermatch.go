@@ -0,0 +1,72 @@
+package gosshacl
+
+import (
+	"os/user"
+	"strings"
+	"sync"
+
+	"github.com/aurora-is-near/sshaclsrv/src/constants"
+
+	"github.com/aurora-is-near/sshaclsrv/src/hostmatch"
+)
+
+// LookupGroups returns the names of the Unix groups of a system user. It can be replaced for other sources of group
+// membership.
+var LookupGroups = func(username string) ([]string, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if g, err := user.LookupGroupId(id); err == nil {
+			ret = append(ret, g.Name)
+		}
+	}
+	return ret, nil
+}
+
+var groupCache = struct {
+	sync.Mutex
+	groups map[string]map[string]bool
+}{groups: make(map[string]map[string]bool)}
+
+// inGroup returns true if the system user is a member of group. Memberships are looked up once per user.
+func inGroup(username, group string) bool {
+	groupCache.Lock()
+	defer groupCache.Unlock()
+	groups, ok := groupCache.groups[username]
+	if !ok {
+		names, err := LookupGroups(username)
+		if err != nil {
+			ErrorLog.Printf("groups of user %s: %s", username, err)
+		}
+		groups = make(map[string]bool, len(names))
+		for _, name := range names {
+			groups[name] = true
+		}
+		groupCache.groups[username] = groups
+	}
+	return groups[group]
+}
+
+// userMatches returns true if the user field of an entry matches the system user. The field is either a user name,
+// a hostmatch pattern, or a group reference ("@<group>") that matches all members of the group.
+func userMatches(field, username string) bool {
+	switch {
+	case field == username:
+		return true
+	case username == "":
+		return false
+	case strings.HasPrefix(field, constants.GroupPrefix):
+		return inGroup(username, field[len(constants.GroupPrefix):])
+	case hostmatch.IsPattern(field):
+		return hostmatch.Compile(field).Match(username)
+	default:
+		return false
+	}
+}
@@ -0,0 +1,62 @@
+package gosshacl
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestUserMatches(t *testing.T) {
+	lookupGroups := LookupGroups
+	defer func() { LookupGroups = lookupGroups }()
+	LookupGroups = func(username string) ([]string, error) {
+		switch username {
+		case "alice":
+			return []string{"alice", "deploy"}, nil
+		case "bob":
+			return []string{"bob"}, nil
+		}
+		return nil, errors.New("unknown user")
+	}
+	log := new(bytes.Buffer)
+	ErrorLog.SetOutput(log)
+	defer ErrorLog.SetOutput(os.Stderr)
+	td := []struct {
+		field, user string
+		match       bool
+	}{
+		{"root", "root", true},
+		{"root", "admin", false},
+		{"app-*", "app-web", true},
+		{"app-*", "app-", true},
+		{"app-*", "db", false},
+		{"*", "anyone", true},
+		{"*", "", false},
+		{"app?", "app1", true},
+		{"app?", "app", false},
+		{"db[a-z]", "dbx", true},
+		{"db[a-z]", "db1", false},
+		{"@deploy", "alice", true},
+		{"@deploy", "bob", false},
+		{"@deploy", "nobody", false},
+		{"@alice", "alice", true},
+	}
+	for _, d := range td {
+		if userMatches(d.field, d.user) != d.match {
+			t.Errorf("userMatches(%q, %q) != %t", d.field, d.user, d.match)
+		}
+	}
+	if !strings.Contains(log.String(), "nobody") {
+		t.Error("failed group lookup not reported")
+	}
+	w := new(bytes.Buffer)
+	keys := strings.Replace(te, "localhost:root", "localhost:@deploy", 1)
+	if err := FindEntry(strings.NewReader(keys), w, "localhost", NewQuery("alice", tkh)); err != nil || w.String() != ok+"\n" {
+		t.Errorf("group entry not found: %v %q", err, w.String())
+	}
+	if err := FindEntry(strings.NewReader(keys), new(bytes.Buffer), "localhost", NewQuery("bob", tkh)); err != ErrNotFound {
+		t.Errorf("group entry matches non-member: %v", err)
+	}
+}
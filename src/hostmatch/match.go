@@ -1,16 +1,47 @@
-// Package hostmatch implements simple wildcard matching for hostnames. Only the wildcard '*' is supported, which matches
-// all characters except for '.' (dot), including empty. Matching is greedy, it will stop only at the next unmatched rune.
+// Package hostmatch implements wildcard matching for hostnames. The wildcard '*' matches all characters except for
+// '.' (dot), including empty, and "**" matches all characters including dots, spanning labels. '?' matches a single
+// character except for '.', and "[a-z0-9]" a single character (not '.') of a class of characters and ranges, which is
+// negated by a leading '!' or '^'. All other characters match themselves. Patterns without "**", '?' or classes keep
+// the original greedy matching: '*' consumes everything up to the next '.', so "web*01.node.com" matches no host.
+// Lists of patterns are separated by ',' and may contain exclusions prefixed with '!', but not only exclusions. IPv4
+// and IPv6 addresses and CIDR prefixes match hostnames that are addresses within them.
 package hostmatch
 
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
 const (
 	wildcardRune = '*'
 	stopRune     = '.'
+	singleRune   = '?'
+	classOpen    = '['
+	classClose   = ']'
+	classRange   = '-'
+	excludeRune  = '!'
+	listDelim    = ","
+)
+
+var (
+	// ErrPattern is returned for patterns that cannot be parsed.
+	ErrPattern = errors.New("invalid host pattern")
+	// ErrNetwork is returned for CIDR prefixes with host bits set.
+	ErrNetwork = errors.New("network prefix with host bits set")
+	// ErrExcludeOnly is returned for lists that contain exclusions but no pattern to exclude from.
+	ErrExcludeOnly = errors.New("host list contains only exclusions")
 )
 
 type match interface {
 	match(input []rune) (n int, match, rem []rune, ok bool)
 }
 
+// variable is implemented by elements that may also match fewer runes than match returns, down to none.
+type variable interface {
+	variable()
+}
+
 func matchUntil(input []rune, until rune) (n int, match, rem []rune, ok bool) {
 	for n, r := range input {
 		if r == until {
@@ -26,10 +57,78 @@ func (m wildcard) match(input []rune) (n int, match, rem []rune, ok bool) {
 	return matchUntil(input, stopRune)
 }
 
-type starsearch struct{}
+func (m wildcard) variable() {}
+
+// greedy is the wildcard of patterns without extended syntax. Like the original matcher, it consumes all runes up to
+// the next stopRune and never gives any of them back, so "web*01" matches no host.
+type greedy struct{}
+
+func (m greedy) match(input []rune) (n int, match, rem []rune, ok bool) {
+	return matchUntil(input, stopRune)
+}
+
+type globstar struct{}
 
-func (m starsearch) match(input []rune) (n int, match, rem []rune, ok bool) {
-	return matchUntil(input, wildcardRune)
+func (m globstar) match(input []rune) (n int, match, rem []rune, ok bool) {
+	return len(input), input, input[len(input):], true
+}
+
+func (m globstar) variable() {}
+
+// class matches a single rune other than stopRune that is within one of its ranges, or outside of all if negated.
+type class struct {
+	ranges [][2]rune
+	negate bool
+}
+
+func (m class) match(input []rune) (n int, match, rem []rune, ok bool) {
+	if len(input) == 0 || input[0] == stopRune {
+		return 0, nil, nil, false
+	}
+	in := false
+	for _, r := range m.ranges {
+		if input[0] >= r[0] && input[0] <= r[1] {
+			in = true
+			break
+		}
+	}
+	if in == m.negate {
+		return 0, nil, nil, false
+	}
+	return 1, input[:1], input[1:], true
+}
+
+// network matches hostnames that are addresses within the network.
+type network struct {
+	*net.IPNet
+}
+
+func (m network) match(input []rune) (n int, match, rem []rune, ok bool) {
+	ip := net.ParseIP(string(input))
+	if ip == nil || !m.Contains(ip) {
+		return 0, nil, nil, false
+	}
+	return len(input), input, input[len(input):], true
+}
+
+// ParseNetwork returns the network of an address or CIDR prefix, or nil if s is neither. ErrNetwork is returned for
+// prefixes with host bits set.
+func ParseNetwork(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	ip, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, nil
+	}
+	if !ip.Equal(n.IP) {
+		return nil, ErrNetwork
+	}
+	return n, nil
 }
 
 type literal []rune
@@ -49,35 +148,193 @@ func (m literal) match(input []rune) (n int, match, rem []rune, ok bool) {
 // Pattern contains a pattern to match against.
 type Pattern []match
 
-// Compile a string into a matching pattern. Supports one wildcard (*) that stops at (.) and is greedy.
+// Compile a string into a matching pattern. Malformed character classes match themselves literally.
 func Compile(patternString string) Pattern {
+	ret, _ := parse([]rune(patternString), false)
+	return ret
+}
+
+// Parse a string into a matching pattern, returning ErrPattern for malformed character classes.
+func Parse(patternString string) (Pattern, error) {
+	return parse([]rune(patternString), true)
+}
+
+func parse(ps []rune, strict bool) (Pattern, error) {
+	if n, err := ParseNetwork(string(ps)); err != nil {
+		if strict {
+			return nil, err
+		}
+	} else if n != nil {
+		return Pattern{network{n}}, nil
+	}
 	ret := make(Pattern, 0, 3)
-	ps := []rune(patternString)
+	star := match(greedy{})
+	if extended(ps) {
+		star = wildcard{}
+	}
+	var lit literal
+	flush := func(m match) {
+		if len(lit) > 0 {
+			ret, lit = append(ret, lit), nil
+		}
+		ret = append(ret, m)
+	}
 	for len(ps) > 0 {
-		if ps[0] == wildcardRune {
-			ret = append(ret, wildcard{})
-			ps = ps[1:]
+		switch ps[0] {
+		case wildcardRune:
+			if len(ps) > 1 && ps[1] == wildcardRune {
+				flush(globstar{})
+				ps = ps[2:]
+				continue
+			}
+			flush(star)
+		case singleRune:
+			flush(class{negate: true})
+		case classOpen:
+			c, n, ok := parseClass(ps)
+			if !ok {
+				if strict {
+					return nil, ErrPattern
+				}
+				lit = append(lit, ps[0])
+				break
+			}
+			flush(c)
+			ps = ps[n:]
 			continue
+		default:
+			lit = append(lit, ps[0])
 		}
-		_, m, r, _ := starsearch{}.match(ps)
-		if len(m) == 0 {
-			break
+		ps = ps[1:]
+	}
+	if len(lit) > 0 {
+		ret = append(ret, lit)
+	}
+	return ret, nil
+}
+
+// IsPattern returns true if s contains wildcards or character classes, as opposed to a plain name that only matches
+// itself.
+func IsPattern(s string) bool {
+	return strings.ContainsAny(s, string([]rune{wildcardRune, singleRune, classOpen}))
+}
+
+// extended returns true if the pattern uses syntax beyond the original '*', which then matches with backtracking.
+func extended(ps []rune) bool {
+	for i, r := range ps {
+		if r == singleRune || r == classOpen || (r == wildcardRune && i+1 < len(ps) && ps[i+1] == wildcardRune) {
+			return true
 		}
-		ps = r
-		ret = append(ret, literal(m))
 	}
-	return ret
+	return false
+}
+
+// parseClass parses a character class at the start of ps and returns it with the number of runes it spans.
+func parseClass(ps []rune) (c class, n int, ok bool) {
+	i := 1
+	if i < len(ps) && (ps[i] == excludeRune || ps[i] == '^') {
+		c.negate = true
+		i++
+	}
+	for ; i < len(ps) && ps[i] != classClose; i++ {
+		r := [2]rune{ps[i], ps[i]}
+		if i+2 < len(ps) && ps[i+1] == classRange && ps[i+2] != classClose {
+			if r[1] = ps[i+2]; r[1] < r[0] {
+				return c, 0, false
+			}
+			i += 2
+		}
+		c.ranges = append(c.ranges, r)
+	}
+	if i >= len(ps) || len(c.ranges) == 0 {
+		return c, 0, false
+	}
+	return c, i + 1, true
 }
 
 // Match s to the compiled pattern.
 func (p Pattern) Match(s string) bool {
-	ps := []rune(s)
-	for _, m := range p {
-		_, _, r, ok := m.match(ps)
-		if !ok {
-			return false
+	return p.matchRunes([]rune(s))
+}
+
+func (p Pattern) matchRunes(ps []rune) bool {
+	if len(p) == 0 {
+		return len(ps) == 0
+	}
+	n, _, _, ok := p[0].match(ps)
+	if !ok {
+		return false
+	}
+	if _, ok := p[0].(variable); !ok {
+		return p[1:].matchRunes(ps[n:])
+	}
+	for ; n >= 0; n-- {
+		if p[1:].matchRunes(ps[n:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// List is a list of patterns and exclusions. A hostname matches if it matches any of the patterns and none of the
+// exclusions.
+type List struct {
+	include []Pattern
+	exclude []Pattern
+}
+
+// ParseList parses a comma separated list of patterns. Patterns prefixed with '!' are exclusions, which require at
+// least one pattern to exclude from: ErrExcludeOnly is returned for lists of exclusions only.
+func ParseList(s string) (List, error) {
+	var list List
+	for _, e := range strings.Split(s, listDelim) {
+		e = strings.TrimSpace(e)
+		exclude := strings.HasPrefix(e, string(excludeRune))
+		if exclude {
+			e = e[1:]
+		}
+		if e == "" {
+			return list, ErrPattern
+		}
+		p, err := Parse(e)
+		if err != nil {
+			return list, err
+		}
+		if exclude {
+			list.exclude = append(list.exclude, p)
+		} else {
+			list.include = append(list.include, p)
+		}
+	}
+	if len(list.include) == 0 {
+		return list, ErrExcludeOnly
+	}
+	return list, nil
+}
+
+// Match returns true if s matches the list.
+func (list List) Match(s string) bool {
+	return list.MatchAny(s)
+}
+
+// MatchAny returns true if one of names matches the list, and none of them is excluded. It is used for hosts known
+// by several names, like their hostname and addresses.
+func (list List) MatchAny(names ...string) bool {
+	all := make([][]rune, len(names))
+	for i, name := range names {
+		all[i] = []rune(name)
+		for _, p := range list.exclude {
+			if p.matchRunes(all[i]) {
+				return false
+			}
+		}
+	}
+	for _, ps := range all {
+		for _, p := range list.include {
+			if p.matchRunes(ps) {
+				return true
+			}
 		}
-		ps = r
 	}
-	return len(ps) == 0
+	return false
 }
@@ -49,3 +49,87 @@ func TestMatchersLiteral(t *testing.T) {
 		t.Error("literal: wrong match")
 	}
 }
+
+func TestPatternMatch(t *testing.T) {
+	td := []struct {
+		pattern, host string
+		match         bool
+	}{
+		{"*", "localhost", true},
+		{"*", "alpha.node.com", false},
+		{"*.node.com", "alpha.node.com", true},
+		{"web*.node.com", "web.node.com", true},
+		{"*-db.node.com", "eu-db.node.com", false},
+		{"web*01.node.com", "web-a01.node.com", false},
+		{"web*.node.com", "web-a01.node.com", true},
+		{"*-db?.node.com", "eu-db1.node.com", true},
+		{"*-db[0-9].node.com", "eu-db-db1.node.com", true},
+		{"db?.node.com", "db1.node.com", true},
+		{"db?.node.com", "db.node.com", false},
+		{"db?node.com", "db.node.com", false},
+		{"db[0-9].node.com", "db7.node.com", true},
+		{"db[0-9].node.com", "dbx.node.com", false},
+		{"db[!0-9].node.com", "dbx.node.com", true},
+		{"db[^0-9].node.com", "db7.node.com", false},
+		{"db[abc-].node.com", "db-.node.com", true},
+		{"db[0-9]?.eu.*.node.com", "db1a.eu.rack3.node.com", true},
+		{"db[0-9]?.eu.*.node.com", "db1a.eu.rack3.dc.node.com", false},
+		{"**.node.com", "a.b.c.node.com", true},
+		{"**.node.com", "node.com", false},
+		{"**", "a.b", true},
+		{"db[0-9.node.com", "db[0-9.node.com", true},
+	}
+	for _, e := range td {
+		if m := Compile(e.pattern).Match(e.host); m != e.match {
+			t.Errorf("%s %s: %t", e.pattern, e.host, m)
+		}
+	}
+}
+
+func TestParseList(t *testing.T) {
+	list, err := ParseList("web*.node.com, !web-canary.node.com")
+	if err != nil {
+		t.Fatalf("ParseList: %s", err)
+	}
+	if !list.Match("web-1.node.com") || list.Match("web-canary.node.com") || list.Match("db.node.com") {
+		t.Error("exclusion not applied")
+	}
+	if _, err := ParseList("!*.test.node.com"); err != ErrExcludeOnly {
+		t.Errorf("exclusions only: %v", err)
+	}
+	for _, s := range []string{"a,,b", "!", "db[0-9.node.com", "db[].node.com", "db[9-0].node.com"} {
+		if _, err := ParseList(s); err != ErrPattern {
+			t.Errorf("%q accepted", s)
+		}
+	}
+}
+
+func TestNetworkMatch(t *testing.T) {
+	td := []struct {
+		pattern, host string
+		match         bool
+	}{
+		{"10.20.0.0/16", "10.20.1.5", true},
+		{"10.20.0.0/16", "10.21.1.5", false},
+		{"10.20.0.0/16", "alpha.node.com", false},
+		{"10.20.1.5", "10.20.1.5", true},
+		{"2001:db8::/32", "2001:db8:0:1::5", true},
+		{"2001:db8::1", "2001:0db8::0001", true},
+		{"2001:db8::/32", "10.20.1.5", false},
+	}
+	for _, e := range td {
+		if m := Compile(e.pattern).Match(e.host); m != e.match {
+			t.Errorf("%s %s: %t", e.pattern, e.host, m)
+		}
+	}
+	list, err := ParseList("10.20.0.0/16,!10.20.99.0/24")
+	if err != nil {
+		t.Fatalf("ParseList: %s", err)
+	}
+	if !list.MatchAny("alpha.node.com", "10.20.1.5") || list.MatchAny("alpha.node.com", "10.20.99.1") || list.MatchAny("alpha.node.com") {
+		t.Error("MatchAny")
+	}
+	if _, err := Parse("10.20.1.5/16"); err != ErrNetwork {
+		t.Errorf("prefix with host bits: %v", err)
+	}
+}
@@ -0,0 +1,321 @@
+package hostmatch
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Set is a compiled set of pattern lists. Patterns are split into labels and stored in a trie, starting with the
+// rightmost label, so that a hostname is matched against all lists in a single walk instead of one pattern after the
+// other. Labels that are literals are looked up directly, other labels are matched against the hostname label, and
+// the labels left of a "**" are matched as a whole against the remaining labels of the hostname. Network patterns are
+// matched linearly.
+type Set struct {
+	root     *node
+	networks []setEntry
+	patterns []setPattern
+	lists    int // Number of lists added.
+}
+
+// setPattern records which list a pattern belongs to.
+type setPattern struct {
+	list    int
+	exclude bool
+}
+
+type setEntry struct {
+	id      int
+	pattern Pattern
+}
+
+type labelEdge struct {
+	key   string
+	label Pattern
+	next  *node
+}
+
+type node struct {
+	literal  map[string]*node
+	patterns []*labelEdge
+	rest     []setEntry // Patterns that span the remaining labels of the hostname, containing "**".
+	terminal []int      // Patterns that end with this label.
+}
+
+func newNode() *node {
+	return &node{literal: make(map[string]*node)}
+}
+
+// NewSet returns an empty set.
+func NewSet() *Set {
+	return &Set{root: newNode()}
+}
+
+// Len returns the number of lists in the set.
+func (set *Set) Len() int {
+	return set.lists
+}
+
+// Add a list to the set and return its index, which identifies the list in the results of Match and Hosts.
+func (set *Set) Add(list List) int {
+	idx := set.lists
+	set.lists++
+	for _, p := range list.include {
+		set.add(p, setPattern{list: idx})
+	}
+	for _, p := range list.exclude {
+		set.add(p, setPattern{list: idx, exclude: true})
+	}
+	return idx
+}
+
+func (set *Set) add(p Pattern, sp setPattern) {
+	id := len(set.patterns)
+	set.patterns = append(set.patterns, sp)
+	if len(p) == 1 {
+		if _, ok := p[0].(network); ok {
+			set.networks = append(set.networks, setEntry{id: id, pattern: p})
+			return
+		}
+	}
+	labels := splitLabels(p)
+	n := set.root
+	for i := len(labels) - 1; i >= 0; i-- {
+		label := labels[i]
+		if hasGlobstar(label) {
+			n.rest = append(n.rest, setEntry{id: id, pattern: joinLabels(labels[:i+1])})
+			return
+		}
+		n = n.child(label)
+	}
+	n.terminal = append(n.terminal, id)
+}
+
+// child returns the node reached through label, adding it if necessary.
+func (n *node) child(label Pattern) *node {
+	if lit, ok := literalLabel(label); ok {
+		next, ok := n.literal[lit]
+		if !ok {
+			next = newNode()
+			n.literal[lit] = next
+		}
+		return next
+	}
+	key := labelKey(label)
+	for _, e := range n.patterns {
+		if e.key == key {
+			return e.next
+		}
+	}
+	e := &labelEdge{key: key, label: label, next: newNode()}
+	n.patterns = append(n.patterns, e)
+	return e.next
+}
+
+// splitLabels splits a pattern at the dots of its literals. Other elements never match a dot.
+func splitLabels(p Pattern) []Pattern {
+	labels := make([]Pattern, 0, 4)
+	var cur Pattern
+	for _, m := range p {
+		lit, ok := m.(literal)
+		if !ok {
+			cur = append(cur, m)
+			continue
+		}
+		for {
+			i := indexRune(lit, stopRune)
+			if i < 0 {
+				if len(lit) > 0 {
+					cur = append(cur, lit)
+				}
+				break
+			}
+			if i > 0 {
+				cur = append(cur, lit[:i])
+			}
+			labels, cur = append(labels, cur), nil
+			lit = lit[i+1:]
+		}
+	}
+	return append(labels, cur)
+}
+
+func joinLabels(labels []Pattern) Pattern {
+	ret := make(Pattern, 0, 2*len(labels))
+	for i, label := range labels {
+		if i > 0 {
+			ret = append(ret, literal{stopRune})
+		}
+		ret = append(ret, label...)
+	}
+	return ret
+}
+
+func indexRune(rs []rune, r rune) int {
+	for i := range rs {
+		if rs[i] == r {
+			return i
+		}
+	}
+	return -1
+}
+
+func hasGlobstar(label Pattern) bool {
+	for _, m := range label {
+		if _, ok := m.(globstar); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// literalLabel returns the string a label matches, if it only matches a single string.
+func literalLabel(label Pattern) (string, bool) {
+	switch len(label) {
+	case 0:
+		return "", true
+	case 1:
+		if lit, ok := label[0].(literal); ok {
+			return string(lit), true
+		}
+	}
+	return "", false
+}
+
+func labelKey(label Pattern) string {
+	var b strings.Builder
+	for _, m := range label {
+		_, _ = fmt.Fprintf(&b, "%T%v", m, m)
+	}
+	return b.String()
+}
+
+// matcher holds the state of matching names against a set.
+type matcher struct {
+	set      *Set
+	hit      []bool
+	hits     []int
+	included []bool
+	excluded []bool
+}
+
+func (set *Set) newMatcher() *matcher {
+	return &matcher{
+		set:      set,
+		hit:      make([]bool, len(set.patterns)),
+		hits:     make([]int, 0, 16),
+		included: make([]bool, set.lists),
+		excluded: make([]bool, set.lists),
+	}
+}
+
+func (m *matcher) mark(id int) {
+	if !m.hit[id] {
+		m.hit[id] = true
+		m.hits = append(m.hits, id)
+	}
+}
+
+func (m *matcher) walk(n *node, labels [][]rune) {
+	if len(labels) > 0 && len(n.rest) > 0 {
+		remaining := labels[0]
+		if len(labels) > 1 {
+			remaining = joinRunes(labels)
+		}
+		for _, e := range n.rest {
+			if e.pattern.matchRunes(remaining) {
+				m.mark(e.id)
+			}
+		}
+	}
+	if len(labels) == 0 {
+		for _, id := range n.terminal {
+			m.mark(id)
+		}
+		return
+	}
+	last := labels[len(labels)-1]
+	if next, ok := n.literal[string(last)]; ok {
+		m.walk(next, labels[:len(labels)-1])
+	}
+	for _, e := range n.patterns {
+		if e.label.matchRunes(last) {
+			m.walk(e.next, labels[:len(labels)-1])
+		}
+	}
+}
+
+func joinRunes(labels [][]rune) []rune {
+	var l int
+	for _, label := range labels {
+		l += len(label) + 1
+	}
+	ret := make([]rune, 0, l)
+	for i, label := range labels {
+		if i > 0 {
+			ret = append(ret, stopRune)
+		}
+		ret = append(ret, label...)
+	}
+	return ret
+}
+
+// match appends the indices of the lists matching names to ret and resets the matcher.
+func (m *matcher) match(ret []int, names ...string) []int {
+	for _, name := range names {
+		labels := strings.Split(name, string(stopRune))
+		runes := make([][]rune, len(labels))
+		for i, label := range labels {
+			runes[i] = []rune(label)
+		}
+		m.walk(m.set.root, runes)
+		for _, e := range m.set.networks {
+			if e.pattern.Match(name) {
+				m.mark(e.id)
+			}
+		}
+	}
+	for _, id := range m.hits {
+		p := m.set.patterns[id]
+		if p.exclude {
+			m.excluded[p.list] = true
+		} else {
+			m.included[p.list] = true
+		}
+	}
+	start := len(ret)
+	for _, id := range m.hits {
+		p := m.set.patterns[id]
+		if m.included[p.list] && !m.excluded[p.list] {
+			m.included[p.list] = false
+			ret = append(ret, p.list)
+		}
+	}
+	sort.Ints(ret[start:])
+	for _, id := range m.hits {
+		p := m.set.patterns[id]
+		m.hit[id], m.included[p.list], m.excluded[p.list] = false, false, false
+	}
+	m.hits = m.hits[:0]
+	return ret
+}
+
+// Match returns the indices of the lists that match a host known by names, in ascending order. It is equivalent to
+// calling MatchAny on each list.
+func (set *Set) Match(names ...string) []int {
+	return set.newMatcher().match(nil, names...)
+}
+
+// Hosts returns, for every list in the set, the indices of the hosts that match it, in ascending order.
+func (set *Set) Hosts(hosts []string) [][]int {
+	ret := make([][]int, set.lists)
+	m := set.newMatcher()
+	var lists []int
+	for i, host := range hosts {
+		lists = m.match(lists[:0], host)
+		for _, idx := range lists {
+			ret[idx] = append(ret[idx], i)
+		}
+	}
+	return ret
+}
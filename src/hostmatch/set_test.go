@@ -0,0 +1,166 @@
+package hostmatch
+
+import (
+	"fmt"
+	"testing"
+)
+
+var setLists = []string{
+	"*.node.com",
+	"alpha.node.com",
+	"**.com, !beta.node.com",
+	"db[0-9]?.eu.*.node.com",
+	"**",
+	"*",
+	"*.com,!*.node.com",
+	"web*.node.com,!web-canary.node.com",
+	"a**b.com",
+	"**.com",
+	"10.20.0.0/16",
+	"10.20.*.5",
+	"",
+	"[.-/]x.com",
+	"*.*.node.com,alpha.node.com",
+}
+
+var setHosts = []string{
+	"alpha.node.com",
+	"beta.node.com",
+	"db12.eu.west.node.com",
+	"db1.eu.west.node.com",
+	"web1.node.com",
+	"web-canary.node.com",
+	"a.x.b.com",
+	"ab.com",
+	"com",
+	".com",
+	"10.20.1.5",
+	"10.21.1.5",
+	"localhost",
+	"",
+	"x.node.org",
+	"a.b.node.com",
+}
+
+func TestSet(t *testing.T) {
+	set := NewSet()
+	lists := make([]List, len(setLists))
+	for i, s := range setLists {
+		var err error
+		if s == "" {
+			lists[i] = List{include: []Pattern{Compile("")}}
+		} else if lists[i], err = ParseList(s); err != nil {
+			t.Fatalf("ParseList %s: %s", s, err)
+		}
+		if idx := set.Add(lists[i]); idx != i {
+			t.Fatalf("Add: index %d, expected %d", idx, i)
+		}
+	}
+	hosts := set.Hosts(setHosts)
+	for i, host := range setHosts {
+		var expect []int
+		for j, list := range lists {
+			if list.MatchAny(host) {
+				expect = append(expect, j)
+			}
+		}
+		if got := set.Match(host); fmt.Sprint(got) != fmt.Sprint(expect) {
+			t.Errorf("%q: matched lists %v, expected %v", host, got, expect)
+		}
+		for _, j := range expect {
+			var found bool
+			for _, k := range hosts[j] {
+				found = found || k == i
+			}
+			if !found {
+				t.Errorf("%q missing from hosts of list %q", host, setLists[j])
+			}
+		}
+	}
+	for j, list := range lists {
+		expect := 0
+		for _, host := range setHosts {
+			if list.MatchAny(host) {
+				expect++
+			}
+		}
+		if len(hosts[j]) != expect {
+			t.Errorf("list %q: %d hosts, expected %d", setLists[j], len(hosts[j]), expect)
+		}
+	}
+	var expect []int
+	for j, list := range lists {
+		if list.MatchAny("web-canary.node.com", "10.20.1.5") {
+			expect = append(expect, j)
+		}
+	}
+	if got := set.Match("web-canary.node.com", "10.20.1.5"); fmt.Sprint(got) != fmt.Sprint(expect) {
+		t.Errorf("several names: matched lists %v, expected %v", got, expect)
+	}
+	if got := set.Match(); len(got) != 0 {
+		t.Errorf("no names matched lists %v", got)
+	}
+}
+
+func benchmarkHosts(n int) []string {
+	hosts := make([]string, n)
+	for i := range hosts {
+		hosts[i] = fmt.Sprintf("%s%d.%s.dc%d.example.com", []string{"db", "web", "mail", "cache"}[i%4], i/4%100, []string{"eu", "us", "ap"}[i%3], i%20)
+	}
+	return hosts
+}
+
+func benchmarkLists(n int) []List {
+	lists := make([]List, n)
+	for i := range lists {
+		var s string
+		switch i % 4 {
+		case 0:
+			s = fmt.Sprintf("db*.*.dc%d.example.com", i%20)
+		case 1:
+			s = fmt.Sprintf("web%d?.eu.**, !web%d0.eu.dc1.example.com", i%10, i%10)
+		case 2:
+			s = fmt.Sprintf("mail%d.us.dc%d.example.com", i%100, i%20)
+		default:
+			s = fmt.Sprintf("cache[0-%d]*.ap.*.example.com", i%10)
+		}
+		lists[i], _ = ParseList(s)
+	}
+	return lists
+}
+
+func BenchmarkSetCompile(b *testing.B) {
+	lists := benchmarkLists(2000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		set := NewSet()
+		for _, list := range lists {
+			set.Add(list)
+		}
+	}
+}
+
+func BenchmarkSetHosts(b *testing.B) {
+	hosts := benchmarkHosts(10000)
+	set := NewSet()
+	for _, list := range benchmarkLists(2000) {
+		set.Add(list)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		set.Hosts(hosts)
+	}
+}
+
+func BenchmarkListsHosts(b *testing.B) {
+	hosts := benchmarkHosts(10000)
+	lists := benchmarkLists(2000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, list := range lists {
+			for _, host := range hosts {
+				list.Match(host)
+			}
+		}
+	}
+}
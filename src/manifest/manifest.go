@@ -0,0 +1,110 @@
+// Package manifest implements the manifest line of per-host keyfiles. The manifest is a signed comment line that
+// carries a monotonically increasing serial, the generation time, and the number and hash of all other lines, so that
+// nodes can detect rollback and truncation of downloaded keyfiles.
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Prefix starts the message of a manifest line. It is a comment for parsers that do not know manifests.
+	Prefix = "#manifest"
+
+	fieldDelim = ":"
+	timeFormat = "20060102150405"
+)
+
+var (
+	// ErrFormat is returned if a manifest cannot be parsed.
+	ErrFormat = errors.New("manifest: invalid format")
+)
+
+// Manifest describes the content of a per-host keyfile.
+type Manifest struct {
+	Serial    uint64    // Monotonically increasing serial.
+	Generated time.Time // Time of generation.
+	Lines     int       // Number of lines, excluding the manifest.
+	Hash      string    // Hash over all lines, excluding the manifest.
+}
+
+// String returns the manifest as message to be signed.
+func (m Manifest) String() string {
+	return strings.Join([]string{Prefix, strconv.FormatUint(m.Serial, 10), m.Generated.UTC().Format(timeFormat),
+		strconv.Itoa(m.Lines), m.Hash}, fieldDelim)
+}
+
+// IsManifest returns true if msg is a manifest message.
+func IsManifest(msg []byte) bool {
+	return strings.HasPrefix(string(msg), Prefix+fieldDelim)
+}
+
+// Parse a manifest message.
+func Parse(msg []byte) (*Manifest, error) {
+	var err error
+	if !IsManifest(msg) {
+		return nil, ErrFormat
+	}
+	f := strings.Split(strings.TrimSpace(string(msg)), fieldDelim)
+	if len(f) != 5 {
+		return nil, ErrFormat
+	}
+	m := new(Manifest)
+	if m.Serial, err = strconv.ParseUint(f[1], 10, 64); err != nil {
+		return nil, ErrFormat
+	}
+	if m.Generated, err = time.Parse(timeFormat, f[2]); err != nil {
+		return nil, ErrFormat
+	}
+	if m.Lines, err = strconv.Atoi(f[3]); err != nil || m.Lines < 0 {
+		return nil, ErrFormat
+	}
+	m.Hash = f[4]
+	return m, nil
+}
+
+// Summer calculates line count and hash over lines.
+type Summer struct {
+	lines int
+	h     hash.Hash
+}
+
+// NewSummer returns a new Summer.
+func NewSummer() *Summer {
+	return &Summer{h: sha256.New()}
+}
+
+// Add a line, without line delimiter.
+func (s *Summer) Add(line []byte) {
+	s.lines++
+	_, _ = s.h.Write(line)
+	_, _ = s.h.Write([]byte{'\n'})
+}
+
+// Manifest returns a manifest for the lines added so far.
+func (s *Summer) Manifest(serial uint64, generated time.Time) *Manifest {
+	return &Manifest{
+		Serial:    serial,
+		Generated: generated,
+		Lines:     s.lines,
+		Hash:      base64.RawStdEncoding.EncodeToString(s.h.Sum(nil)),
+	}
+}
+
+// Verify that the lines added so far match the manifest.
+func (s *Summer) Verify(m *Manifest) error {
+	if m.Lines != s.lines {
+		return fmt.Errorf("manifest: expected %d lines, got %d", m.Lines, s.lines)
+	}
+	if m.Hash != base64.RawStdEncoding.EncodeToString(s.h.Sum(nil)) {
+		return errors.New("manifest: hash mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package manifest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestManifest(t *testing.T) {
+	lines := []string{"first line", "second line"}
+	s := NewSummer()
+	for _, l := range lines {
+		s.Add([]byte(l))
+	}
+	m := s.Manifest(1633000000, time.Now())
+	p, err := Parse([]byte(m.String()))
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	if p.Serial != m.Serial || p.Lines != 2 || p.Hash != m.Hash || p.Generated.Unix() != m.Generated.Unix() {
+		t.Error("manifest corrupted")
+	}
+	v := NewSummer()
+	v.Add([]byte(lines[0]))
+	if err := v.Verify(p); err == nil {
+		t.Error("truncation not detected")
+	}
+	v.Add([]byte(lines[0]))
+	if err := v.Verify(p); err == nil {
+		t.Error("modification not detected")
+	}
+	if _, err := Parse([]byte("#manifest:x:20211010101010:1:abc")); err != ErrFormat {
+		t.Error("invalid serial accepted")
+	}
+}
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"net"
 	"time"
 
 	"github.com/aurora-is-near/sshaclsrv/src/sshkey"
@@ -18,18 +19,25 @@ type Action struct {
 	// Push determines if keys for this role are deployed to the servers proactively.
 	Push bool `yaml:"Push"`
 	// Options contains a list of ssh-authorized-keys options.
-	Options    string `yaml:"Options"`
-	sshoptions sshkey.Options
+	Options string `yaml:"Options"`
+	// SourceNetworks restricts the client address to a list of CIDR prefixes or addresses.
+	SourceNetworks []string `yaml:"SourceNetworks"`
+	// Window restricts access to a recurring period of time, like "Mon-Fri 08:00-18:00 Europe/Berlin".
+	Window         string `yaml:"Window"`
+	sshoptions     sshkey.Options
+	sourceNetworks []*net.IPNet
 }
 
 // UnmarshalYAML parses an Action from YAML.
 func (action *Action) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var err error
 	type ActionT struct {
-		User    string `yaml:"User"`
-		Expire  string `yaml:"Expire"`
-		Push    bool   `yaml:"Push"`
-		Options string `yaml:"Options"`
+		User           string   `yaml:"User"`
+		Expire         string   `yaml:"Expire"`
+		Push           bool     `yaml:"Push"`
+		Options        string   `yaml:"Options"`
+		SourceNetworks []string `yaml:"SourceNetworks"`
+		Window         string   `yaml:"Window"`
 	}
 	var tmp ActionT
 	if err := unmarshal(&tmp); err != nil {
@@ -41,5 +49,7 @@ func (action *Action) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	action.User = SystemUserName(tmp.User)
 	action.Push = tmp.Push
 	action.Options = tmp.Options
+	action.SourceNetworks = tmp.SourceNetworks
+	action.Window = tmp.Window
 	return nil
 }
@@ -0,0 +1,179 @@
+package model
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aurora-is-near/sshaclsrv/src/fileperm"
+
+	"github.com/aurora-is-near/sshaclsrv/src/sshkey"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// certificateSkew is subtracted from the start of certificate validity to allow for clock differences.
+	certificateSkew = time.Minute * 5
+	// sourceAddressOption is the certificate critical option that restricts the client address.
+	sourceAddressOption = "source-address"
+)
+
+var (
+	// ErrNoCAKey is returned if certificates are requested without CAKeyFile.
+	ErrNoCAKey = errors.New("no CA key configured")
+	// ErrNoGrant is returned if the model grants no access that could be put into a certificate.
+	ErrNoGrant = errors.New("no access granted")
+	// ErrWindowCertificate is returned if the granted access is limited by windows, which certificates cannot enforce.
+	ErrWindowCertificate = errors.New("access is limited by windows, which certificates cannot enforce")
+	// ErrConflictingOptions is returned if the selected system users have different options.
+	ErrConflictingOptions = errors.New("system users have conflicting options, request them separately")
+	// ErrRevoked is returned if the user or key is revoked.
+	ErrRevoked = errors.New("user or key is revoked")
+	// ErrNoServer is returned if a certificate is requested without naming the server it is for.
+	ErrNoServer = errors.New("certificates require a server")
+	// ErrNoKeyID is returned if the user has no KeyID, so that hosts could not look up the principals of certificates.
+	ErrNoKeyID = errors.New("certificates require a KeyID for principal lookups")
+)
+
+func (persistence *Persistence) caSigner() (ssh.Signer, error) {
+	if persistence.CAKeyFile == "" {
+		return nil, ErrNoCAKey
+	}
+	f, err := os.Open(persistence.CAKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	if err := fileperm.PermissionCheck(f); err != nil {
+		return nil, fmt.Errorf("CA key %s: %s", persistence.CAKeyFile, err)
+	}
+	d, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(d)
+}
+
+// IssueCertificate signs an OpenSSH user certificate for the key of user with the given fingerprint, using the
+// compiled model. The certificate carries the user's KeyID and the principals published for it, so that every host
+// decides access through its principals lookup. Validity and options are taken from the key and the actions granting
+// the user access to server, limited to systemUsers if not empty.
+func (persistence *Persistence) IssueCertificate(user UserName, fingerprint string, server ServerName, systemUsers ...SystemUserName) (*ssh.Certificate, error) {
+	if server == "" {
+		return nil, ErrNoServer
+	}
+	if err := persistence.initSign(); err != nil {
+		return nil, err
+	}
+	signer, err := persistence.caSigner()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := persistence.loadRows()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := newKeyCache().getKeys(persistence.UserDir, user)
+	if err != nil {
+		return nil, err
+	}
+	var key *sshkey.Key
+	for _, k := range keys {
+		if k.Fingerprint == fingerprint {
+			key = k
+		}
+	}
+	if key == nil {
+		return nil, fmt.Errorf("user '%s' has no key '%s'", user, fingerprint)
+	}
+	revocations, err := persistence.readRevocations()
+	if err != nil {
+		return nil, err
+	}
+	if revocations.revokes(user, fingerprint) {
+		return nil, ErrRevoked
+	}
+	row, err := rows.grant(user, server, systemUsers)
+	if err != nil {
+		return nil, err
+	}
+	if row.KeyID == "" {
+		return nil, ErrNoKeyID
+	}
+	principals := append([]string(nil), row.Principals...)
+	sort.Strings(principals)
+	if len(row.Windows) > 0 {
+		return nil, ErrWindowCertificate
+	}
+	perms, err := row.sshoptions.Apply(key.Options).Permissions()
+	if err != nil {
+		return nil, fmt.Errorf("action options '%s': %s", row.Options, err)
+	}
+	if len(row.SourceNetworks) > 0 {
+		if perms.CriticalOptions == nil {
+			perms.CriticalOptions = make(map[string]string)
+		}
+		perms.CriticalOptions[sourceAddressOption] = strings.Join(row.SourceNetworks, ",")
+	}
+	notBefore, notAfter := row.validity(persistence.AuthTime.FromTime(user), key.NotAfter)
+	if notAfter.Before(time.Now()) {
+		return nil, ErrNoGrant
+	}
+	validAfter := time.Now().Add(-certificateSkew)
+	if notBefore.After(validAfter) {
+		validAfter = notBefore
+	}
+	serial, err := nextSerial(persistence.certSerialFile)
+	if err != nil {
+		return nil, err
+	}
+	c := &ssh.Certificate{
+		Key:             key.Key,
+		Serial:          serial,
+		CertType:        ssh.UserCert,
+		KeyId:           row.KeyID,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(validAfter.Unix()),
+		ValidBefore:     ssh.CertTimeInfinity,
+		Permissions:     *perms,
+	}
+	if !notAfter.IsZero() {
+		c.ValidBefore = uint64(notAfter.Unix())
+	}
+	if err := c.SignCert(rand.Reader, signer); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// grant returns a row granting access to user on server, limited to systemUsers if not empty. All selected rows must
+// share the same options, expiry, period of access and source networks. Rows for patterns and groups of system users
+// are skipped.
+func (rows CompiledRows) grant(user UserName, server ServerName, systemUsers []SystemUserName) (*ConfigRow, error) {
+	selected := make(map[SystemUserName]bool, len(systemUsers))
+	for _, systemUser := range systemUsers {
+		selected[systemUser] = true
+	}
+	var grant *ConfigRow
+	for _, row := range rows {
+		if row.User != user || row.Server != server || row.SystemUser.isPattern() || (len(selected) > 0 && !selected[row.SystemUser]) {
+			continue
+		}
+		if grant == nil {
+			grant = row
+		} else if row.Options != grant.Options || row.Expire != grant.Expire || strings.Join(row.SourceNetworks, ",") != strings.Join(grant.SourceNetworks, ",") || len(row.Windows) != len(grant.Windows) ||
+			!row.NotBefore.Equal(grant.NotBefore) || !row.NotAfter.Equal(grant.NotAfter) {
+			return nil, ErrConflictingOptions
+		}
+	}
+	if grant == nil {
+		return nil, ErrNoGrant
+	}
+	return grant, nil
+}
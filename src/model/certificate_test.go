@@ -0,0 +1,99 @@
+package model
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aurora-is-near/sshaclsrv/src/sshkey"
+
+	"golang.org/x/crypto/ssh"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestPersistence_IssueCertificate(t *testing.T) {
+	pers, dir := testPersistence(t, strings.Replace(data, "Roles: [MasterAdmin]", "Roles: [MasterAdmin]\n    KeyID: johann@corp\n    Principals: [johann, dba]", 1))
+	caKey := writeCAKey(t, pers, dir)
+	if _, err := pers.CompileAndStore(); err != nil {
+		t.Fatalf("CompileAndStore: %s", err)
+	}
+	key, _ := sshkey.ParseKey(users["Johann"][0])
+	if _, err := pers.IssueCertificate("Johann", key.Fingerprint, "beta.node.com"); err != ErrConflictingOptions {
+		t.Errorf("conflicting options must be refused: %v", err)
+	}
+	if _, err := pers.IssueCertificate("Johann", key.Fingerprint, ""); err != ErrNoServer {
+		t.Errorf("certificate without server: %v", err)
+	}
+	if _, err := pers.IssueCertificate("Kyrill", key.Fingerprint, "beta.node.com"); err == nil {
+		t.Error("certificate for server without grants")
+	}
+	if _, err := pers.IssueCertificate("Johann", key.Fingerprint, "gamma.node.com", "mysql"); err != ErrNoGrant {
+		t.Errorf("certificate for unknown server: %v", err)
+	}
+	manifestSerial, _ := ioutil.ReadFile(pers.serialFile)
+	cert, err := pers.IssueCertificate("Johann", key.Fingerprint, "alpha.node.com")
+	if err != nil {
+		t.Fatalf("IssueCertificate: %s", err)
+	}
+	caPub, _ := ssh.NewPublicKey(caKey.Public())
+	checker := &ssh.CertChecker{IsUserAuthority: func(auth ssh.PublicKey) bool {
+		return string(auth.Marshal()) == string(caPub.Marshal())
+	}}
+	if err := checker.CheckCert("dba", cert); err != nil {
+		t.Errorf("CheckCert: %s", err)
+	}
+	if err := checker.CheckCert("mysql", cert); err == nil {
+		t.Error("system user became principal")
+	}
+	if d, _ := ioutil.ReadFile(pers.serialFile); string(d) != string(manifestSerial) {
+		t.Error("certificate changed the manifest serial")
+	}
+	if strings.Join(cert.ValidPrincipals, ",") != "dba,johann" || cert.KeyId != "johann@corp" {
+		t.Errorf("wrong principals or key ID: %v %s", cert.ValidPrincipals, cert.KeyId)
+	}
+	if _, ok := cert.Extensions["permit-pty"]; ok {
+		t.Error("no-pty not applied")
+	}
+	if validBefore := time.Unix(int64(cert.ValidBefore), 0); validBefore.After(time.Now().Add(time.Hour*73)) || validBefore.Before(time.Now().Add(time.Hour*71)) {
+		t.Errorf("wrong validity: %s", validBefore)
+	}
+	if _, err := pers.IssueCertificate("Johann", strings.Repeat("A", 43), "alpha.node.com"); err == nil {
+		t.Error("unknown key must be refused")
+	}
+	if _, err := pers.IssueCertificate("Nobody", key.Fingerprint, "alpha.node.com"); err == nil {
+		t.Error("unknown user must be refused")
+	}
+	pers, dir = testPersistence(t, data)
+	writeCAKey(t, pers, dir)
+	if _, err := pers.CompileAndStore(); err != nil {
+		t.Fatalf("CompileAndStore: %s", err)
+	}
+	if _, err := pers.IssueCertificate("Johann", key.Fingerprint, "alpha.node.com"); err != ErrNoKeyID {
+		t.Errorf("certificate without KeyID: %v", err)
+	}
+}
+
+func TestGrantPeriods(t *testing.T) {
+	start := time.Now().Add(time.Hour * 24 * 7).UTC().Truncate(time.Second)
+	model := strings.Replace(data, "    Roles: [MasterAdmin]", fmt.Sprintf(`    Roles: [MasterAdmin]
+    Grants:
+      - Role: Database Admin
+        NotBefore: %s`, start.Format(time.RFC3339)), 1)
+	tvar := SystemACL{}
+	if err := yaml.Unmarshal([]byte(model), &tvar); err != nil {
+		t.Fatalf("error unmarshal: %v", err)
+	}
+	_, rows, err := tvar.toRows()
+	if err != nil {
+		t.Fatalf("Error compile: %s", err)
+	}
+	if _, err := rows.grant("Johann", "alpha.node.com", []SystemUserName{"mysql"}); err != ErrConflictingOptions {
+		t.Errorf("future grant merged with unlimited role: %v", err)
+	}
+	if row, err := rows.grant("Kyrill", "alpha.node.com", []SystemUserName{"mysql"}); err != nil || !row.NotBefore.IsZero() {
+		t.Errorf("unlimited grant: %v", err)
+	}
+}
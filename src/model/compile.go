@@ -1,6 +1,10 @@
 package model
 
 import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/aurora-is-near/sshaclsrv/src/sshkey"
@@ -20,6 +24,22 @@ type ConfigRow struct {
 	Expire time.Duration
 	// Options are ssh-authorized-keys options to apply.
 	Options string
+	// NotBefore is the start of the access, immediately if zero.
+	NotBefore time.Time
+	// NotAfter is the end of the access, unlimited if zero.
+	NotAfter time.Time
+	// KeyID is the key ID of the user's certificates, empty if no principals are issued.
+	KeyID string `json:",omitempty"`
+	// Principals are issued for certificates with KeyID.
+	Principals []string `json:",omitempty"`
+	// SourceNetworks restrict the client address, unrestricted if empty.
+	SourceNetworks []string `json:",omitempty"`
+	// Windows restrict the time of access. Access is only allowed while all windows are open.
+	Windows []string `json:",omitempty"`
+	// Role is the role assigned to the user that granted the access.
+	Role RoleName `json:",omitempty"`
+	// Via are the roles through which Role includes the role that contains the action, empty if Role contains it.
+	Via []RoleName `json:",omitempty"`
 
 	sshoptions sshkey.Options
 }
@@ -79,28 +99,60 @@ func (acl *SystemACL) toRows() (warnings []string, rows CompiledRows, err error)
 		return nil, nil, err
 	}
 	warnings = acl.warnings()
+	expanded, w := acl.expandRoles()
+	warnings = append(warnings, w...)
+	for name, action := range acl.Actions {
+		if action.User.isPattern() && !action.Push {
+			warnings = append(warnings, fmt.Sprintf("action '%s' with systemuser pattern '%s' is only distributed in per-host files, set Push", name, action.User))
+		}
+	}
 	configs := make(CompiledRows, 0, 10)
+	disjoint := make(map[string]bool)
+	groupGrants := acl.groupGrants()
 UserLoop:
 	for _, user := range acl.Users {
 		if !user.NotAfter.IsZero() && user.NotAfter.Before(time.Now()) {
 			continue UserLoop
 		}
-		for _, userRole := range user.Roles {
-			if role, ok := acl.Roles[userRole]; ok {
+		principals := user.Principals
+		if user.KeyID != "" && len(principals) == 0 {
+			principals = []string{string(user.name)}
+		}
+		for _, grant := range user.grants(groupGrants[user.name]...) {
+			if grant.expired(time.Now()) {
+				continue
+			}
+			if role, ok := expanded[grant.Role]; ok {
 				for _, serverMatch := range role {
 					for _, serverAction := range serverMatch.Actions {
 						if actionDetail, ok := acl.Actions[serverAction]; ok {
+							networks, ok := sourceNetworks(serverMatch.sourceNetworks, actionDetail.sourceNetworks)
+							if !ok {
+								if w := fmt.Sprintf("role '%s', serverdesc '%s', action '%s' has no common source networks", serverMatch.role, serverMatch.serverDesc, serverAction); !disjoint[w] {
+									disjoint[w] = true
+									warnings = append(warnings, w)
+								}
+								continue
+							}
 							for _, server := range serverMatch.servers {
 								for _, specificAction := range server.Actions {
 									if specificAction == serverAction {
 										configs = append(configs, &ConfigRow{
-											Server:     server.servername,
-											Push:       actionDetail.Push,
-											SystemUser: actionDetail.User,
-											User:       user.name,
-											Expire:     minExpireNoZero(actionDetail.Expire, user.Expire),
-											Options:    actionDetail.Options,
-											sshoptions: actionDetail.sshoptions,
+											Server:         server.servername,
+											Push:           actionDetail.Push,
+											SystemUser:     actionDetail.User,
+											User:           user.name,
+											Expire:         minExpireNoZero(minExpireNoZero(actionDetail.Expire, user.Expire), grant.expire),
+											Options:        actionDetail.Options,
+											NotBefore:      grant.NotBefore,
+											NotAfter:       grant.NotAfter,
+											KeyID:          user.KeyID,
+											Principals:     principals,
+											SourceNetworks: networks,
+											Windows:        windows(append(append([]string{grant.Window}, serverMatch.windows...), actionDetail.Window)...),
+											Role:           grant.Role,
+											Via:            serverMatch.via,
+											sshoptions:     actionDetail.sshoptions,
 										})
 									}
 								}
@@ -113,3 +165,65 @@ UserLoop:
 	}
 	return warnings, configs, nil
 }
+
+// validity returns the period of access for a key with keyNotAfter, if the user authenticated at authTime.
+func (row *ConfigRow) validity(authTime, keyNotAfter time.Time) (notBefore, notAfter time.Time) {
+	if row.NotBefore.After(authTime) {
+		authTime = row.NotBefore
+	}
+	tl := TimeList{authTime.Add(row.Expire), keyNotAfter, row.NotAfter}
+	sort.Sort(tl)
+	return row.NotBefore, tl[0]
+}
+
+// sourceNetworks returns the source networks of a row that is restricted by both the role and the action, and false if
+// no address would be allowed by both.
+func sourceNetworks(role, action []*net.IPNet) ([]string, bool) {
+	networks := action
+	switch {
+	case len(role) == 0:
+	case len(action) == 0:
+		networks = role
+	default:
+		if networks = sshkey.IntersectNetworks(role, action); len(networks) == 0 {
+			return nil, false
+		}
+	}
+	if len(networks) == 0 {
+		return nil, true
+	}
+	return strings.Split(sshkey.NetworksToString(networks), ","), true
+}
+
+// windows returns the access windows that are set, without duplicates.
+func windows(windows ...string) []string {
+	ret := make([]string, 0, len(windows))
+WindowLoop:
+	for _, w := range windows {
+		if w == "" {
+			continue
+		}
+		for _, e := range ret {
+			if e == w {
+				continue WindowLoop
+			}
+		}
+		ret = append(ret, w)
+	}
+	if len(ret) == 0 {
+		return nil
+	}
+	return ret
+}
+
+// conditions returns the conditions of the entries generated from the row.
+func (row *ConfigRow) conditions() sshkey.Conditions {
+	networks, _ := sshkey.ParseNetworks(row.SourceNetworks)
+	conditions := sshkey.Conditions{SourceNetworks: networks}
+	for _, window := range row.Windows {
+		if w, err := sshkey.ParseWindow(window); err == nil {
+			conditions.Windows = append(conditions.Windows, w)
+		}
+	}
+	return conditions
+}
@@ -1,7 +1,11 @@
 package model
 
 import (
+	"fmt"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 
@@ -72,3 +76,501 @@ func TestYAML(t *testing.T) {
 //    - Remove non-present entries.
 
 // Model ->
+
+func TestGrants(t *testing.T) {
+	start := time.Now().Add(time.Hour * 24).UTC().Truncate(time.Second)
+	model := strings.Replace(data, "    Roles: [Database Admin]", fmt.Sprintf(`    NotAfter: %s
+    Grants:
+      - Role: MasterAdmin
+        NotBefore: %s
+      - Role: Database Admin
+        NotAfter: 2001-01-01T00:00:00Z`, start.Add(time.Hour*48).Format(time.RFC3339), start.Format(time.RFC3339)), 1)
+	tvar := SystemACL{}
+	if err := yaml.Unmarshal([]byte(model), &tvar); err != nil {
+		t.Fatalf("error unmarshal: %v", err)
+	}
+	_, rows, err := tvar.toRows()
+	if err != nil {
+		t.Fatalf("Error compile: %s", err)
+	}
+	var n int
+	for _, row := range rows {
+		if row.User != "Kyrill" {
+			continue
+		}
+		n++
+		if !row.NotBefore.Equal(start) || !row.NotAfter.Equal(start.Add(time.Hour*48)) {
+			t.Errorf("wrong validity %s - %s", row.NotBefore, row.NotAfter)
+		}
+		notBefore, notAfter := row.validity(time.Now(), time.Time{})
+		if !notBefore.Equal(start) || !notAfter.Equal(start.Add(time.Hour*48)) {
+			t.Errorf("wrong access period %s - %s", notBefore, notAfter)
+		}
+	}
+	if n != 3 {
+		t.Errorf("expected 3 rows for future grant, got %d", n)
+	}
+}
+
+func TestSystemUserPatterns(t *testing.T) {
+	td := map[SystemUserName]bool{
+		"mail":     true,
+		"app-*":    true,
+		"app?":     true,
+		"db[a-z]":  true,
+		"db[z-a]":  false,
+		"db[a-z":   false,
+		"@dep?":    false,
+		"@dep[a]":  false,
+		"@deploy":  true,
+		"@":        false,
+		"@dep*":    false,
+		"@a:b":     false,
+		"../mysql": false,
+	}
+	for user, valid := range td {
+		tvar := SystemACL{}
+		if err := yaml.Unmarshal([]byte(strings.Replace(data, "User: postmaster", "User: \""+string(user)+"\"", 1)), &tvar); err != nil {
+			t.Fatalf("error unmarshal: %v", err)
+		}
+		if _, _, err := tvar.toRows(); (err == nil) != valid {
+			t.Errorf("systemuser '%s': valid %t, error %v", user, valid, err)
+		}
+	}
+	tvar := SystemACL{}
+	model := strings.Replace(data, "User: postmaster\n    Expire: 3d\n    Push: true", "User: \"@mail\"\n    Expire: 3d", 1)
+	if err := yaml.Unmarshal([]byte(model), &tvar); err != nil {
+		t.Fatalf("error unmarshal: %v", err)
+	}
+	warnings, _, err := tvar.toRows()
+	if err != nil {
+		t.Fatalf("Error compile: %s", err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "@mail") {
+		t.Errorf("missing warning for unpushed group: %v", warnings)
+	}
+}
+
+func TestSourceNetworks(t *testing.T) {
+	model := strings.Replace(data, "    Options: no-pty\n", "    Options: no-pty\n    SourceNetworks: [10.0.0.0/8, 192.168.0.0/16]\n", 1)
+	model = strings.Replace(model, `    "alpha.node.com":
+      - Database Admin`, `    "alpha.node.com":
+      Actions: [Database Admin]
+      SourceNetworks: [10.20.0.0/16, 172.16.0.0/12]`, 1)
+	tvar := SystemACL{}
+	if err := yaml.Unmarshal([]byte(model), &tvar); err != nil {
+		t.Fatalf("error unmarshal: %v", err)
+	}
+	_, rows, err := tvar.toRows()
+	if err != nil {
+		t.Fatalf("Error compile: %s", err)
+	}
+	for _, row := range rows {
+		var expect string
+		switch {
+		case row.SystemUser != "mysql":
+		case row.User == "Kyrill":
+			expect = "10.20.0.0/16"
+		default:
+			expect = "10.0.0.0/8,192.168.0.0/16"
+		}
+		if s := strings.Join(row.SourceNetworks, ","); s != expect {
+			t.Errorf("%s %s: source networks %s, expected %s", row.User, row.SystemUser, s, expect)
+		}
+	}
+	tvar = SystemACL{}
+	disjoint := strings.Replace(model, "10.20.0.0/16, ", "", 1)
+	if err := yaml.Unmarshal([]byte(disjoint), &tvar); err != nil {
+		t.Fatalf("error unmarshal: %v", err)
+	}
+	warnings, rows, err := tvar.toRows()
+	if err != nil {
+		t.Fatalf("Error compile: %s", err)
+	}
+	for _, row := range rows {
+		if row.User == "Kyrill" {
+			t.Error("disjoint source networks must not grant access")
+		}
+	}
+	if len(warnings) != 1 {
+		t.Errorf("expected warning for disjoint source networks: %v", warnings)
+	}
+	tvar = SystemACL{}
+	conflict := strings.Replace(model, "Options: no-pty", `Options: from="10.0.0.0/8"`, 1)
+	if err := yaml.Unmarshal([]byte(conflict), &tvar); err != nil {
+		t.Fatalf("error unmarshal: %v", err)
+	}
+	if _, _, err := tvar.toRows(); err == nil {
+		t.Error("source networks and from option must conflict")
+	}
+}
+
+func TestWindows(t *testing.T) {
+	model := strings.Replace(data, "    Options: no-pty\n", "    Options: no-pty\n    Window: Mon-Fri 08:00-18:00 Europe/Berlin\n", 1)
+	model = strings.Replace(model, "    Roles: [Database Admin]", `    Grants:
+      - Role: Database Admin
+        Window: "* 22:00-06:00"`, 1)
+	tvar := SystemACL{}
+	if err := yaml.Unmarshal([]byte(model), &tvar); err != nil {
+		t.Fatalf("error unmarshal: %v", err)
+	}
+	_, rows, err := tvar.toRows()
+	if err != nil {
+		t.Fatalf("Error compile: %s", err)
+	}
+	for _, row := range rows {
+		var expect string
+		switch {
+		case row.SystemUser != "mysql":
+		case row.User == "Kyrill":
+			expect = "* 22:00-06:00|Mon-Fri 08:00-18:00 Europe/Berlin"
+		default:
+			expect = "Mon-Fri 08:00-18:00 Europe/Berlin"
+		}
+		if s := strings.Join(row.Windows, "|"); s != expect {
+			t.Errorf("%s %s: windows %s, expected %s", row.User, row.SystemUser, s, expect)
+		}
+		if len(row.conditions().Windows) != len(row.Windows) {
+			t.Errorf("windows missing from conditions: %v", row.Windows)
+		}
+	}
+	tvar = SystemACL{}
+	if err := yaml.Unmarshal([]byte(strings.Replace(model, "Mon-Fri 08:00", "Mon-Fri 8", 1)), &tvar); err != nil {
+		t.Fatalf("error unmarshal: %v", err)
+	}
+	if _, _, err := tvar.toRows(); err == nil {
+		t.Error("invalid window must fail validation")
+	}
+}
+
+func TestServerPatterns(t *testing.T) {
+	model := strings.Replace(data, `"*.node.com":`, `"**.com, !beta.node.com":`, 1)
+	tvar := SystemACL{}
+	if err := yaml.Unmarshal([]byte(model), &tvar); err != nil {
+		t.Fatalf("error unmarshal: %v", err)
+	}
+	_, rows, err := tvar.toRows()
+	if err != nil {
+		t.Fatalf("Error compile: %s", err)
+	}
+	for _, row := range rows {
+		if row.User == "Johann" && row.Server != "alpha.node.com" {
+			t.Errorf("excluded server granted: %s", row.Server)
+		}
+	}
+	for _, pattern := range []string{"db[9-0].node.com", "!beta.node.com", "2001:db8::/32"} {
+		tvar = SystemACL{}
+		invalid := strings.Replace(data, `"*.node.com":`, `"`+pattern+`":`, 1)
+		if err := yaml.Unmarshal([]byte(invalid), &tvar); err != nil {
+			t.Fatalf("error unmarshal: %v", err)
+		}
+		if _, _, err := tvar.toRows(); err == nil {
+			t.Errorf("invalid server pattern '%s' accepted", pattern)
+		}
+	}
+}
+
+func TestNetworkServers(t *testing.T) {
+	model := strings.Replace(data, "  beta.node.com:\n", "  10.20.1.5:\n    - Database Admin\n  beta.node.com:\n", 1)
+	model = strings.Replace(model, `    "alpha.node.com":
+      - Database Admin`, `    "10.20.0.0/16":
+      - Database Admin`, 1)
+	tvar := SystemACL{}
+	if err := yaml.Unmarshal([]byte(model), &tvar); err != nil {
+		t.Fatalf("error unmarshal: %v", err)
+	}
+	_, rows, err := tvar.toRows()
+	if err != nil {
+		t.Fatalf("Error compile: %s", err)
+	}
+	var found bool
+	for _, row := range rows {
+		if row.User == "Kyrill" {
+			if row.Server != "10.20.1.5" {
+				t.Errorf("server outside of network granted: %s", row.Server)
+			}
+			found = true
+		}
+	}
+	if !found {
+		t.Error("server within network not granted")
+	}
+}
+
+func TestServerLabels(t *testing.T) {
+	model := strings.Replace(data, `  alpha.node.com:
+    - Database Admin
+  beta.node.com:
+    - Database Admin
+    - Mail Admin`, `  alpha.node.com:
+    Actions: [Database Admin]
+    Labels: {env: prod, tier: db}
+  beta.node.com:
+    Actions: [Database Admin, Mail Admin]
+    Labels: {env: test}`, 1)
+	model = strings.Replace(model, `    "alpha.node.com":
+      - Database Admin`, `    "env=prod,tier=db":
+      - Database Admin`, 1)
+	model = strings.Replace(model, `    "*.node.com":
+      - Database Admin
+      - Mail Admin`, `    "*.node.com":
+      Actions: [Database Admin, Mail Admin]
+      Selector: "env!=prod"`, 1)
+	tvar := SystemACL{}
+	if err := yaml.Unmarshal([]byte(model), &tvar); err != nil {
+		t.Fatalf("error unmarshal: %v", err)
+	}
+	warnings, rows, err := tvar.toRows()
+	if err != nil {
+		t.Fatalf("Error compile: %s", err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+	var found bool
+	for _, row := range rows {
+		switch row.User {
+		case "Kyrill":
+			if row.Server != "alpha.node.com" {
+				t.Errorf("server without labels granted: %s", row.Server)
+			}
+			found = true
+		case "Johann":
+			if row.Server != "beta.node.com" {
+				t.Errorf("server excluded by selector granted: %s", row.Server)
+			}
+		}
+	}
+	if !found {
+		t.Error("server with labels not granted")
+	}
+	tvar = SystemACL{}
+	if err := yaml.Unmarshal([]byte(strings.Replace(model, "env!=prod", "env=staging", 1)), &tvar); err != nil {
+		t.Fatalf("error unmarshal: %v", err)
+	}
+	if warnings, _, err = tvar.toRows(); err != nil {
+		t.Fatalf("Error compile: %s", err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "env=staging") {
+		t.Errorf("missing warning for selector without servers: %v", warnings)
+	}
+	for _, invalid := range []string{`"env=prod,=db":`, `"env=prod,tier=":`} {
+		tvar = SystemACL{}
+		if err := yaml.Unmarshal([]byte(strings.Replace(model, `"env=prod,tier=db":`, invalid, 1)), &tvar); err != nil {
+			t.Fatalf("error unmarshal: %v", err)
+		}
+		if _, _, err := tvar.toRows(); err == nil {
+			t.Errorf("invalid selector %s accepted", invalid)
+		}
+	}
+}
+
+// benchmarkModel returns a model of 10000 servers and 2000 users with two of 400 roles each.
+func benchmarkModel() *SystemACL {
+	kinds := []string{"db", "web", "mail", "cache"}
+	acl := &SystemACL{
+		Servers: make(map[ServerName]*Server),
+		Actions: make(map[ActionName]*Action),
+		Users:   make(map[UserName]*User),
+		Roles:   make(map[RoleName]map[ServerMatch]*Role),
+	}
+	for _, kind := range kinds {
+		acl.Actions[ActionName(kind)] = &Action{User: SystemUserName(kind), Expire: 72 * time.Hour, Push: true}
+	}
+	for i := 0; i < 10000; i++ {
+		kind := kinds[i%4]
+		name := ServerName(fmt.Sprintf("%s%d.%s.dc%d.example.com", kind, i/4%100, []string{"eu", "us", "ap"}[i%3], i%20))
+		acl.Servers[name] = &Server{Actions: []ActionName{ActionName(kind)}, Labels: map[string]string{"tier": kind, "dc": fmt.Sprint(i % 20)}}
+	}
+	for i := 0; i < 400; i++ {
+		kind := kinds[i%4]
+		desc := ServerMatch(fmt.Sprintf("%s%d*.*.dc%d.example.com", kind, i%10+1, i%20))
+		if i%8 == 0 {
+			desc = ServerMatch(fmt.Sprintf("tier=%s,dc=%d", kind, i%20))
+		}
+		acl.Roles[RoleName(fmt.Sprintf("role%d", i))] = map[ServerMatch]*Role{desc: {Actions: []ActionName{ActionName(kind)}}}
+	}
+	for i := 0; i < 2000; i++ {
+		acl.Users[UserName(fmt.Sprintf("user%d", i))] = &User{
+			Expire: 365 * 24 * time.Hour,
+			Roles:  []RoleName{RoleName(fmt.Sprintf("role%d", i%400)), RoleName(fmt.Sprintf("role%d", (i*7+1)%400))},
+		}
+	}
+	return acl
+}
+
+func BenchmarkWarnings(b *testing.B) {
+	acl := benchmarkModel()
+	if err := acl.validate(); err != nil {
+		b.Fatalf("validate: %s", err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		acl.warnings()
+	}
+}
+
+func BenchmarkCompile(b *testing.B) {
+	acl := benchmarkModel()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := acl.toRows(); err != nil {
+			b.Fatalf("Error compile: %s", err)
+		}
+	}
+}
+
+func TestRoleIncludes(t *testing.T) {
+	model := strings.Replace(data, `    "*.node.com":
+      - Database Admin
+      - Mail Admin`, `    "*.node.com":
+      Actions: [Mail Admin]
+      Roles: [Database Admin]
+  Operator:
+    "**":
+      Roles: [MasterAdmin]
+      SourceNetworks: [10.0.0.0/8]`, 1)
+	model = strings.Replace(model, "  Kyrill:\n    Expire: 1Y\n    Roles: [Database Admin]", "  Kyrill:\n    Expire: 1Y\n    Roles: [Operator]", 1)
+	tvar := SystemACL{}
+	if err := yaml.Unmarshal([]byte(model), &tvar); err != nil {
+		t.Fatalf("error unmarshal: %v", err)
+	}
+	warnings, rows, err := tvar.toRows()
+	if err != nil {
+		t.Fatalf("Error compile: %s", err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+	grants := make(map[string]string)
+	for _, row := range rows {
+		via := make([]string, len(row.Via))
+		for i, role := range row.Via {
+			via[i] = string(role)
+		}
+		grants[fmt.Sprintf("%s %s %s", row.User, row.Server, row.SystemUser)] = fmt.Sprintf("%s|%s|%s", row.Role, strings.Join(via, ","), strings.Join(row.SourceNetworks, ","))
+	}
+	expect := map[string]string{
+		"Johann alpha.node.com mysql":     "MasterAdmin|Database Admin|",
+		"Johann beta.node.com postmaster": "MasterAdmin||",
+		"Kyrill alpha.node.com mysql":     "Operator|MasterAdmin,Database Admin|10.0.0.0/8",
+		"Kyrill beta.node.com postmaster": "Operator|MasterAdmin|10.0.0.0/8",
+	}
+	if fmt.Sprint(grants) != fmt.Sprint(expect) {
+		t.Errorf("grants %v, expected %v", grants, expect)
+	}
+	tvar = SystemACL{}
+	restricted := strings.Replace(model, `"**":`, `"beta.node.com":`, 1)
+	if err := yaml.Unmarshal([]byte(restricted), &tvar); err != nil {
+		t.Fatalf("error unmarshal: %v", err)
+	}
+	if _, rows, err = tvar.toRows(); err != nil {
+		t.Fatalf("Error compile: %s", err)
+	}
+	for _, row := range rows {
+		if row.User == "Kyrill" && row.Server != "beta.node.com" {
+			t.Errorf("included role not restricted to servers of including role: %s", row.Server)
+		}
+	}
+	for _, invalid := range []string{
+		strings.Replace(model, `    "alpha.node.com":
+      - Database Admin`, `    "alpha.node.com":
+      Roles: [Operator]`, 1),
+		strings.Replace(model, "Roles: [MasterAdmin]", "Roles: [Operator]", 1),
+		strings.Replace(model, "Roles: [MasterAdmin]", "Roles: [Nobody]", 1),
+	} {
+		tvar = SystemACL{}
+		if err := yaml.Unmarshal([]byte(invalid), &tvar); err != nil {
+			t.Fatalf("error unmarshal: %v", err)
+		}
+		if _, _, err := tvar.toRows(); err == nil || !strings.Contains(err.Error(), "includes") {
+			t.Errorf("cyclic or unknown role include accepted: %v", err)
+		}
+	}
+}
+
+// rowStrings returns the rows as sorted strings, for comparison regardless of order.
+func rowStrings(rows CompiledRows) []string {
+	ret := make([]string, len(rows))
+	for i, row := range rows {
+		ret[i] = fmt.Sprintf("%+v", *row)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func TestGroups(t *testing.T) {
+	direct := SystemACL{}
+	if err := yaml.Unmarshal([]byte(data), &direct); err != nil {
+		t.Fatalf("error unmarshal: %v", err)
+	}
+	_, directRows, err := direct.toRows()
+	if err != nil {
+		t.Fatalf("Error compile: %s", err)
+	}
+	model := strings.Replace(data, "    Roles: [MasterAdmin]\n", "", 1)
+	model = strings.Replace(model, "    Roles: [Database Admin]\n", "", 1)
+	model += `Groups:
+  Admins:
+    Roles: [MasterAdmin]
+    Members: [Johann]
+  DBA:
+    Roles: [Database Admin]
+    Groups: [Oncall]
+  Oncall:
+    Members: [Kyrill]
+`
+	tvar := SystemACL{}
+	if err := yaml.Unmarshal([]byte(model), &tvar); err != nil {
+		t.Fatalf("error unmarshal: %v", err)
+	}
+	_, rows, err := tvar.toRows()
+	if err != nil {
+		t.Fatalf("Error compile: %s", err)
+	}
+	if a, b := rowStrings(rows), rowStrings(directRows); fmt.Sprint(a) != fmt.Sprint(b) {
+		t.Errorf("group rows differ from direct assignment:\n%v\n%v", a, b)
+	}
+	diamond := strings.Replace(model, "    Groups: [Oncall]\n", "    Groups: [Oncall, Primary, Secondary]\n", 1) + `  Primary:
+    Groups: [Oncall]
+  Secondary:
+    Groups: [Oncall]
+    Members: [Kyrill]
+`
+	tvar = SystemACL{}
+	if err := yaml.Unmarshal([]byte(diamond), &tvar); err != nil {
+		t.Fatalf("error unmarshal: %v", err)
+	}
+	if _, rows, err = tvar.toRows(); err != nil {
+		t.Fatalf("Error compile: %s", err)
+	}
+	if a, b := rowStrings(rows), rowStrings(directRows); fmt.Sprint(a) != fmt.Sprint(b) {
+		t.Errorf("diamond membership rows differ from direct assignment:\n%v\n%v", a, b)
+	}
+	tvar = SystemACL{}
+	limited := strings.Replace(model, "    Members: [Kyrill]\n", "    Members: [Kyrill]\n    Expire: 1d\n", 1)
+	limited = strings.Replace(limited, "    Members: [Johann]\n", "    Members: [Johann]\n    NotAfter: 2001-01-01T00:00:00Z\n", 1)
+	if err := yaml.Unmarshal([]byte(limited), &tvar); err != nil {
+		t.Fatalf("error unmarshal: %v", err)
+	}
+	if _, rows, err = tvar.toRows(); err != nil {
+		t.Fatalf("Error compile: %s", err)
+	}
+	if len(rows) != 1 || rows[0].User != "Kyrill" || rows[0].Expire != 24*time.Hour {
+		t.Errorf("group limits not applied: %s", spew.Sdump(rows))
+	}
+	for _, invalid := range []string{
+		strings.Replace(model, "Members: [Kyrill]", "Members: [Nobody]", 1),
+		strings.Replace(model, "Groups: [Oncall]", "Groups: [Nobody]", 1),
+		strings.Replace(model, "Members: [Kyrill]", "Groups: [DBA]", 1),
+		strings.Replace(model, "Roles: [Database Admin]\n    Groups", "Roles: [Nobody]\n    Groups", 1),
+	} {
+		tvar = SystemACL{}
+		if err := yaml.Unmarshal([]byte(invalid), &tvar); err != nil {
+			t.Fatalf("error unmarshal: %v", err)
+		}
+		if _, _, err := tvar.toRows(); err == nil || !strings.Contains(err.Error(), "group") {
+			t.Errorf("invalid group accepted: %v", err)
+		}
+	}
+}
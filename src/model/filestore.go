@@ -1,9 +1,15 @@
 package model
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"strings"
+	"time"
+
+	"github.com/aurora-is-near/sshaclsrv/src/constants"
 )
 
 func (persistence *Persistence) genPaths(row *ConfigRow, keyFingerprint string) (server, user string) {
@@ -12,7 +18,8 @@ func (persistence *Persistence) genPaths(row *ConfigRow, keyFingerprint string)
 
 type fileData map[string][]string
 
-func (data fileData) store() (existingFiles, error) {
+// store writes all files. Files below rolloverDir keep their previous content as rollover generation when it changes.
+func (data fileData) store(rolloverDir string) (existingFiles, error) {
 	var lastError error
 	keepFiles := make(existingFiles)
 	for filePath, content := range data {
@@ -23,14 +30,64 @@ func (data fileData) store() (existingFiles, error) {
 			}
 		}
 		contentB := []byte(strings.Join(content, "\n"))
-		if err := writeFile(filePath, contentB, 0600); err != nil {
+		keepFiles[filePath] = true
+		if !strings.HasPrefix(filePath, rolloverDir+"/") {
+			if err := writeFile(filePath, contentB, 0600); err != nil {
+				lastError = err
+			}
+			continue
+		}
+		rolloverPath, err := keepGeneration(filePath, contentB)
+		if err != nil {
+			lastError = err
+		}
+		if rolloverPath != "" {
+			keepFiles[rolloverPath] = true
+		}
+		if err := replaceFile(filePath, contentB, 0600); err != nil {
 			lastError = err
 		}
-		keepFiles[filePath] = true
 	}
 	return keepFiles, lastError
 }
 
+// keepGeneration links filePath to its rollover if its content differs from content, leaving filePath in place. It
+// returns the path of the rollover if one exists.
+func keepGeneration(filePath string, content []byte) (string, error) {
+	rolloverPath := filePath + constants.RolloverExtension
+	current, err := ioutil.ReadFile(filePath)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return "", err
+	case !bytes.Equal(current, content):
+		tmpFile := fmt.Sprintf("%s.tmp-%d", rolloverPath, time.Now().UnixNano())
+		if err := os.Link(filePath, tmpFile); err != nil {
+			return "", err
+		}
+		defer func() { _ = os.Remove(tmpFile) }()
+		if err := os.Rename(tmpFile, rolloverPath); err != nil {
+			return "", err
+		}
+	}
+	if _, err := os.Stat(rolloverPath); err != nil {
+		return "", nil
+	}
+	return rolloverPath, nil
+}
+
+// replaceFile writes data to a temporary file next to filename and renames it to filename, so that filename is
+// replaced at once and kept if writing fails.
+func replaceFile(filename string, data []byte, perm os.FileMode) error {
+	tmpFile := fmt.Sprintf("%s.tmp-%d", filename, time.Now().UnixNano())
+	if err := writeFile(tmpFile, data, perm); err != nil {
+		_ = os.Remove(tmpFile)
+		return err
+	}
+	defer func() { _ = os.Remove(tmpFile) }()
+	return os.Rename(tmpFile, filename)
+}
+
 type existingFiles map[string]bool
 
 func (keep existingFiles) cleanup(baseDir string, subDirs ...string) error {
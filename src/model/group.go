@@ -0,0 +1,137 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aurora-is-near/sshaclsrv/src/stringduration"
+)
+
+// GroupName is the name of a group/team of users.
+type GroupName string
+
+// Group is a team of users that are assigned roles together.
+type Group struct {
+	name GroupName
+	// Roles are assigned to all members.
+	Roles []RoleName `yaml:"Roles"`
+	// Members are the users within the group.
+	Members []UserName `yaml:"Members"`
+	// Groups are member groups, whose members are members of this group too.
+	Groups []GroupName `yaml:"Groups"`
+	// NotAfter ends the membership of all members at a date.
+	NotAfter time.Time `yaml:"NotAfter"`
+	// Expire enforces expiration for keys authenticated through the group.
+	Expire time.Duration `yaml:"Expire"`
+}
+
+// UnmarshalYAML parses YAML into Group.
+func (group *Group) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var err error
+	type GroupT struct {
+		Roles    []RoleName  `yaml:"Roles"`
+		Members  []UserName  `yaml:"Members"`
+		Groups   []GroupName `yaml:"Groups"`
+		NotAfter time.Time   `yaml:"NotAfter"`
+		Expire   string      `yaml:"Expire"`
+	}
+	var tmp GroupT
+	if err := unmarshal(&tmp); err != nil {
+		return err
+	}
+	if group.Expire, err = stringduration.Parse(tmp.Expire); err != nil {
+		return err
+	}
+	group.Roles = tmp.Roles
+	group.Members = tmp.Members
+	group.Groups = tmp.Groups
+	group.NotAfter = tmp.NotAfter
+	return nil
+}
+
+// validateGroups returns an error for invalid group names, unknown members, groups and roles, and groups that contain
+// themselves.
+func (acl *SystemACL) validateGroups() error {
+	for name, group := range acl.Groups {
+		group.name = name
+		if !validUserName(UserName(name)) {
+			return fmt.Errorf("group '%s' contains illegal characters", name)
+		}
+		for _, role := range group.Roles {
+			if _, ok := acl.Roles[role]; !ok {
+				return fmt.Errorf("group '%s' references unknown role '%s'", name, role)
+			}
+		}
+		for _, member := range group.Members {
+			if _, ok := acl.Users[member]; !ok {
+				return fmt.Errorf("group '%s' contains unknown user '%s'", name, member)
+			}
+		}
+		for _, member := range group.Groups {
+			if _, ok := acl.Groups[member]; !ok {
+				return fmt.Errorf("group '%s' contains unknown group '%s'", name, member)
+			}
+		}
+	}
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[GroupName]int)
+	var visit func(name GroupName) error
+	visit = func(name GroupName) error {
+		switch state[name] {
+		case done:
+			return nil
+		case visiting:
+			return fmt.Errorf("group '%s' contains itself", name)
+		}
+		state[name] = visiting
+		for _, member := range acl.Groups[name].Groups {
+			if err := visit(member); err != nil {
+				return err
+			}
+		}
+		state[name] = done
+		return nil
+	}
+	names := make([]GroupName, 0, len(acl.Groups))
+	for name := range acl.Groups {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groupGrants returns the role assignments of every user through the groups they are members of, directly or through
+// member groups. Grants are limited by the NotAfter and Expire of all groups on the way.
+func (acl *SystemACL) groupGrants() map[UserName][]Grant {
+	ret := make(map[UserName][]Grant)
+	for _, group := range acl.Groups {
+		if len(group.Roles) == 0 {
+			continue
+		}
+		var collect func(member *Group, notAfter time.Time, expire time.Duration)
+		collect = func(member *Group, notAfter time.Time, expire time.Duration) {
+			tl := TimeList{notAfter, member.NotAfter}
+			sort.Sort(tl)
+			notAfter, expire = tl[0], minExpireNoZero(expire, member.Expire)
+			for _, user := range member.Members {
+				for _, role := range group.Roles {
+					ret[user] = append(ret[user], Grant{Role: role, NotAfter: notAfter, expire: expire})
+				}
+			}
+			for _, sub := range member.Groups {
+				collect(acl.Groups[sub], notAfter, expire)
+			}
+		}
+		collect(group, time.Time{}, 0)
+	}
+	return ret
+}
@@ -0,0 +1,148 @@
+package model
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/aurora-is-near/sshaclsrv/src/sshkey"
+)
+
+// roleEntry is a role entry with actions, restricted by the entries through which its role was included.
+type roleEntry struct {
+	*Role
+	servers        []*Server
+	sourceNetworks []*net.IPNet
+	windows        []string
+	via            []RoleName // Included roles from the expanded role down to the role of the entry.
+}
+
+// checkIncludes returns an error if a role includes an unknown role or, directly or indirectly, itself.
+func (acl *SystemACL) checkIncludes() error {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[RoleName]int)
+	var visit func(name RoleName, path []RoleName) error
+	visit = func(name RoleName, path []RoleName) error {
+		switch state[name] {
+		case done:
+			return nil
+		case visiting:
+			for i := range path {
+				if path[i] == name {
+					path = path[i:]
+					break
+				}
+			}
+			return fmt.Errorf("role '%s' includes itself through '%s'", name, joinRoles(append(path, name)))
+		}
+		state[name] = visiting
+		path = append(path, name)
+		for serverdesc, entry := range acl.Roles[name] {
+			for _, include := range entry.Roles {
+				if _, ok := acl.Roles[include]; !ok {
+					return fmt.Errorf("role '%s', server '%s' includes unknown role '%s'", name, serverdesc, include)
+				}
+				if err := visit(include, path); err != nil {
+					return err
+				}
+			}
+		}
+		state[name] = done
+		return nil
+	}
+	names := make([]RoleName, 0, len(acl.Roles))
+	for name := range acl.Roles {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func joinRoles(roles []RoleName) string {
+	s := make([]string, len(roles))
+	for i, role := range roles {
+		s[i] = string(role)
+	}
+	return strings.Join(s, "' -> '")
+}
+
+// expandRoles returns the entries with actions of every role, including those of included roles. It requires
+// validate and warnings to have run. Included entries without common servers are left out, and those without common
+// source networks are reported as warnings.
+func (acl *SystemACL) expandRoles() (expanded map[RoleName][]roleEntry, warnings []string) {
+	expanded = make(map[RoleName][]roleEntry, len(acl.Roles))
+	var expand func(name RoleName) []roleEntry
+	expand = func(name RoleName) []roleEntry {
+		if entries, ok := expanded[name]; ok {
+			return entries
+		}
+		entries := make([]roleEntry, 0, len(acl.Roles[name]))
+		for _, entry := range acl.Roles[name] {
+			if len(entry.Actions) > 0 {
+				entries = append(entries, roleEntry{
+					Role:           entry,
+					servers:        entry.servers,
+					sourceNetworks: entry.sourceNetworks,
+					windows:        windows(entry.Window),
+				})
+			}
+			for _, include := range entry.Roles {
+				for _, sub := range expand(include) {
+					servers := intersectServers(entry.servers, sub.servers)
+					if len(servers) == 0 {
+						continue
+					}
+					networks := sub.sourceNetworks
+					switch {
+					case len(entry.sourceNetworks) == 0:
+					case len(networks) == 0:
+						networks = entry.sourceNetworks
+					default:
+						if networks = sshkey.IntersectNetworks(entry.sourceNetworks, networks); len(networks) == 0 {
+							warnings = append(warnings, fmt.Sprintf("role '%s', serverdesc '%s' and included role '%s', serverdesc '%s' have no common source networks", name, entry.serverDesc, sub.role, sub.serverDesc))
+							continue
+						}
+					}
+					entries = append(entries, roleEntry{
+						Role:           sub.Role,
+						servers:        servers,
+						sourceNetworks: networks,
+						windows:        windows(append([]string{entry.Window}, sub.windows...)...),
+						via:            append([]RoleName{include}, sub.via...),
+					})
+				}
+			}
+		}
+		expanded[name] = entries
+		return entries
+	}
+	for name := range acl.Roles {
+		expand(name)
+	}
+	sort.Strings(warnings)
+	return expanded, warnings
+}
+
+// intersectServers returns the servers contained in both a and b.
+func intersectServers(a, b []*Server) []*Server {
+	in := make(map[*Server]bool, len(a))
+	for _, server := range a {
+		in[server] = true
+	}
+	ret := make([]*Server, 0, len(b))
+	for _, server := range b {
+		if in[server] {
+			ret = append(ret, server)
+		}
+	}
+	return ret
+}
@@ -11,12 +11,16 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
-	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/aurora-is-near/sshaclsrv/src/manifest"
+
 	"github.com/aurora-is-near/sshaclsrv/src/constants"
 
+	"github.com/aurora-is-near/sshaclsrv/src/revocation"
+
 	"github.com/aurora-is-near/sshaclsrv/src/util"
 
 	"github.com/aurora-is-near/sshaclsrv/src/delegatesign"
@@ -32,12 +36,18 @@ type Persistence struct {
 	KeyFile   string // File containing delegation key and private key.
 	UserDir   string // Directory containing one file per user which in turn contains one ssh-key per line.
 	BaseDir   string // Directory in which to write publicly accessible output.
+	CAKeyFile string // OpenSSH private key to sign user certificates with.
+
+	RevocationFile string // Optional YAML file of revoked keys, key IDs, delegated subkeys and users.
+	MasterKeyFile  string // Master private key to sign the revocation list with. Required with RevocationFile.
 
 	AuthTime LastAuthTime `json:"-"`
 
 	perKeyDir      string // http(s)://<fqdn/path>/key/<sshfingerprint>/<hostname>/<systemuser>
 	perHostDir     string // http(s)://<fqdn/path>/server/<hostname>
 	modelCacheFile string // File to cache the compiled model to.
+	serialFile     string // File to store the last manifest serial in.
+	certSerialFile string // File to store the last certificate serial in.
 
 	privateKey   ed25519.PrivateKey
 	delegatedKey delegatesign.DelegatedKey
@@ -63,6 +73,8 @@ func (persistence *Persistence) initSign() error {
 		persistence.AuthTime = new(nowTime)
 	}
 	persistence.modelCacheFile = persistence.ModelFile + ".cache"
+	persistence.serialFile = persistence.ModelFile + ".serial"
+	persistence.certSerialFile = persistence.ModelFile + ".certserial"
 	persistence.perKeyDir = path.Join(persistence.BaseDir, constants.PerKeyPath)
 	persistence.perHostDir = path.Join(persistence.BaseDir, constants.PerHostPath)
 	return nil
@@ -164,12 +176,20 @@ func (persistence *Persistence) CompileAndStore() ([]string, error) {
 }
 
 func (persistence *Persistence) store(rows CompiledRows, warnings []string) ([]string, error) {
-	w2, files, err := persistence.genLines(rows)
+	w1, revoked, err := persistence.publishRevocations(rows)
+	warnings = append(warnings, w1...)
+	if err != nil {
+		return warnings, err
+	}
+	w2, files, err := persistence.genLines(rows, revoked)
 	warnings = append(warnings, w2...)
 	if err != nil {
 		return warnings, err
 	}
-	keepfiles, err := files.store()
+	if err := persistence.addManifests(files); err != nil {
+		return warnings, err
+	}
+	keepfiles, err := files.store(persistence.perHostDir)
 	if err != nil {
 		return warnings, err
 	}
@@ -179,7 +199,8 @@ func (persistence *Persistence) store(rows CompiledRows, warnings []string) ([]s
 	return warnings, nil
 }
 
-func (persistence *Persistence) genLines(rows CompiledRows) ([]string, fileData, error) {
+// genLines generates the signed lines of all rows, leaving out revoked keys and key IDs.
+func (persistence *Persistence) genLines(rows CompiledRows, revoked *revocation.List) ([]string, fileData, error) {
 	lines := make(fileData)
 	keyCache := newKeyCache()
 	warnings := make([]string, 0, 10)
@@ -187,6 +208,9 @@ func (persistence *Persistence) genLines(rows CompiledRows) ([]string, fileData,
 	for user, perUserRows := range users {
 	KeyRowLoop:
 		for _, accessRow := range perUserRows {
+			if !revoked.KeyRevoked(constants.KeyIDPrefix + accessRow.KeyID) {
+				persistence.genPrincipalLines(lines, user, accessRow)
+			}
 			keys, err := keyCache.getKeys(persistence.UserDir, user)
 			if err != nil {
 				warnings = append(warnings, fmt.Sprintf("Failed to get keys for '%s': %s", user, err))
@@ -198,18 +222,22 @@ func (persistence *Persistence) genLines(rows CompiledRows) ([]string, fileData,
 			}
 		SingleKeyLoop:
 			for _, key := range keys {
+				if revoked.KeyRevoked(key.Fingerprint) {
+					continue SingleKeyLoop
+				}
 				serverPath, userPath := persistence.genPaths(accessRow, key.Fingerprint)
-				tl := TimeList{persistence.AuthTime.FromTime(user).Add(accessRow.Expire), key.NotAfter}
-				sort.Sort(tl)
-				if tl[0].Before(time.Now()) {
+				notBefore, notAfter := accessRow.validity(persistence.AuthTime.FromTime(user), key.NotAfter)
+				if notAfter.Before(time.Now()) {
 					continue SingleKeyLoop
 				}
 				sshkeyS := key.ApplyToString(accessRow.sshoptions)
-				f := []string{string(accessRow.Server), string(accessRow.SystemUser), key.Fingerprint, sshkey.ExpireTimeToString(tl[0]), sshkeyS}
+				f := []string{string(accessRow.Server), string(accessRow.SystemUser), key.Fingerprint, sshkey.ValidityToString(notBefore, notAfter) + accessRow.conditions().String(), sshkeyS}
 				preLine := strings.Join(f, ":")
 				sig := persistence.delegatedKey.Sign(persistence.privateKey, []byte(preLine))
 				signedLine := fmt.Sprintf("%s:%s", base64.StdEncoding.EncodeToString(sig), preLine)
-				lines[userPath] = []string{signedLine}
+				if !accessRow.SystemUser.isPattern() {
+					lines[userPath] = []string{signedLine}
+				}
 				if e, ok := lines[serverPath]; ok {
 					lines[serverPath] = append(e, signedLine)
 				} else {
@@ -223,11 +251,86 @@ func (persistence *Persistence) genLines(rows CompiledRows) ([]string, fileData,
 	return warnings, lines, nil
 }
 
+// genPrincipalLines adds the signed principal lines of a row to lines. Principal lines carry the certificate key ID,
+// prefixed with "@", instead of the key fingerprint, and a principal instead of the authorized key.
+func (persistence *Persistence) genPrincipalLines(lines fileData, user UserName, accessRow *ConfigRow) {
+	if accessRow.KeyID == "" {
+		return
+	}
+	notBefore, notAfter := accessRow.validity(persistence.AuthTime.FromTime(user), time.Time{})
+	if notAfter.Before(time.Now()) {
+		return
+	}
+	serverPath, userPath := persistence.genPaths(accessRow, constants.KeyIDPrefix+accessRow.KeyID)
+	signedLines := make([]string, 0, len(accessRow.Principals))
+	for _, principal := range accessRow.Principals {
+		f := []string{string(accessRow.Server), string(accessRow.SystemUser), constants.KeyIDPrefix + accessRow.KeyID, sshkey.ValidityToString(notBefore, notAfter) + accessRow.conditions().String(), principal}
+		preLine := strings.Join(f, ":")
+		sig := persistence.delegatedKey.Sign(persistence.privateKey, []byte(preLine))
+		signedLines = append(signedLines, fmt.Sprintf("%s:%s", base64.StdEncoding.EncodeToString(sig), preLine))
+	}
+	if !accessRow.SystemUser.isPattern() {
+		lines[userPath] = signedLines
+	}
+	lines[serverPath] = append(lines[serverPath], signedLines...)
+}
+
+// nextSerial returns the next manifest serial and records it.
+func (persistence *Persistence) nextSerial() (uint64, error) {
+	return nextSerial(persistence.serialFile)
+}
+
+// nextSerial returns the next serial of the counter recorded in filename and records it. Serials never go back in
+// time, even if the record is lost.
+func nextSerial(filename string) (uint64, error) {
+	serial := uint64(time.Now().Unix())
+	if d, err := ioutil.ReadFile(filename); err == nil {
+		if last, err := strconv.ParseUint(strings.TrimSpace(string(d)), 10, 64); err == nil && last >= serial {
+			serial = last + 1
+		}
+	}
+	if err := writeFile(filename, []byte(strconv.FormatUint(serial, 10)+"\n"), 0600); err != nil {
+		return 0, err
+	}
+	return serial, nil
+}
+
+// addManifests prepends a signed manifest line to all per-host files.
+func (persistence *Persistence) addManifests(files fileData) error {
+	serial, err := persistence.nextSerial()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for filePath, lines := range files {
+		if !strings.HasPrefix(filePath, persistence.perHostDir+"/") {
+			continue
+		}
+		summer := manifest.NewSummer()
+		for _, line := range lines {
+			summer.Add([]byte(line))
+		}
+		msg := summer.Manifest(serial, now).String()
+		sig := persistence.delegatedKey.Sign(persistence.privateKey, []byte(msg))
+		files[filePath] = append([]string{fmt.Sprintf("%s:%s", base64.StdEncoding.EncodeToString(sig), msg)}, lines...)
+	}
+	return nil
+}
+
 // Update keys only from compiled model.
 func (persistence *Persistence) Update() ([]string, error) {
 	if err := persistence.initSign(); err != nil {
 		return nil, err
 	}
+	rows, err := persistence.loadRows()
+	if err != nil {
+		return nil, err
+	}
+	return persistence.store(rows, make([]string, 0, 10))
+}
+
+// loadRows reads the compiled model.
+func (persistence *Persistence) loadRows() (CompiledRows, error) {
 	d, err := ioutil.ReadFile(persistence.modelCacheFile)
 	if err != nil {
 		return nil, err
@@ -239,5 +342,5 @@ func (persistence *Persistence) Update() ([]string, error) {
 	for i, r := range rows {
 		rows[i].sshoptions, _ = sshkey.ParseOptions(r.Options)
 	}
-	return persistence.store(rows, make([]string, 0, 10))
+	return rows, nil
 }
@@ -1,11 +1,22 @@
 package model
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/pem"
 	"io/ioutil"
 	"os"
 	"path"
 	"strings"
 	"testing"
+
+	"github.com/aurora-is-near/sshaclsrv/src/constants"
+
+	"github.com/aurora-is-near/sshaclsrv/src/manifest"
+
+	"github.com/aurora-is-near/sshaclsrv/src/revocation"
 )
 
 var users = map[UserName][]string{
@@ -28,32 +39,40 @@ func mkUserFiles(dir string) error {
 	return nil
 }
 
-func TestPersistence_CompileAll(t *testing.T) {
-	dir, err := ioutil.TempDir(os.TempDir(), "compile.*")
-	if err != nil {
-		t.Fatalf("TempDir: %s", err)
+// testPersistence returns a Persistence for model in a temporary directory, with the test users and delegated key.
+func testPersistence(t *testing.T, model string) (*Persistence, string) {
+	dir := t.TempDir()
+	pers := &Persistence{
+		ModelFile: path.Join(dir, "model.cfg"),
+		UserDir:   path.Join(dir, "users"),
+		BaseDir:   path.Join(dir, "public"),
+		KeyFile:   path.Join(dir, "delegate.key"),
 	}
-	userDir := path.Join(dir, "users")
-	if err := mkUserFiles(userDir); err != nil {
+	if err := mkUserFiles(pers.UserDir); err != nil {
 		t.Fatalf("UserDir: %s", err)
 	}
-	modelFile := path.Join(dir, "model.cfg")
-	keyFile := path.Join(dir, "delegate.key")
-	baseDir := path.Join(dir, "public")
-	if err := ioutil.WriteFile(modelFile, []byte(data), 0400); err != nil {
-		t.Errorf("Write mode: %s", err)
+	if err := ioutil.WriteFile(pers.ModelFile, []byte(model), 0400); err != nil {
+		t.Fatalf("Write model: %s", err)
 	}
-	if err := ioutil.WriteFile(keyFile, []byte(delegatedKey), 0400); err != nil {
-		t.Errorf("Write key: %s", err)
+	if err := ioutil.WriteFile(pers.KeyFile, []byte(delegatedKey), 0400); err != nil {
+		t.Fatalf("Write key: %s", err)
 	}
-	defer func() { _ = os.RemoveAll(dir) }()
-	// fmt.Println(dir)
-	pers := Persistence{
-		ModelFile: modelFile,
-		UserDir:   userDir,
-		BaseDir:   baseDir,
-		KeyFile:   keyFile,
+	return pers, dir
+}
+
+// writeCAKey creates a CA key for pers and returns it.
+func writeCAKey(t *testing.T, pers *Persistence, dir string) ed25519.PrivateKey {
+	_, caKey, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(caKey)
+	pers.CAKeyFile = path.Join(dir, "ca.key")
+	if err := ioutil.WriteFile(pers.CAKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0400); err != nil {
+		t.Fatalf("Write CA key: %s", err)
 	}
+	return caKey
+}
+
+func TestPersistence_CompileAll(t *testing.T) {
+	pers, _ := testPersistence(t, data)
 	if warnings, err := pers.CompileAndStore(); err != nil {
 		t.Fatalf("CompileAndStore: %s", err)
 	} else if len(warnings) > 0 {
@@ -65,3 +84,120 @@ func TestPersistence_CompileAll(t *testing.T) {
 		// fmt.Println(warnings)
 	}
 }
+
+func TestPersistence_Manifest(t *testing.T) {
+	pers, dir := testPersistence(t, data)
+	var lastSerial uint64
+	var lastContent []byte
+	hostFile := path.Join(dir, "public", "host", "alpha.node.com")
+	for i := 0; i < 2; i++ {
+		if _, err := pers.CompileAndStore(); err != nil {
+			t.Fatalf("CompileAndStore: %s", err)
+		}
+		d, err := ioutil.ReadFile(hostFile)
+		if err != nil {
+			t.Fatalf("ReadFile: %s", err)
+		}
+		if lastContent != nil {
+			if rollover, err := ioutil.ReadFile(hostFile + constants.RolloverExtension); err != nil || string(rollover) != string(lastContent) {
+				t.Errorf("previous generation not kept: %v", err)
+			}
+		}
+		lastContent = d
+		lines := strings.Split(string(d), "\n")
+		m, err := manifest.Parse([]byte(lines[0][strings.IndexByte(lines[0], ':')+1:]))
+		if err != nil {
+			t.Fatalf("manifest.Parse: %s", err)
+		}
+		if m.Lines != len(lines)-1 {
+			t.Errorf("manifest line count %d, file has %d", m.Lines, len(lines)-1)
+		}
+		if m.Serial <= lastSerial {
+			t.Error("serial not increasing")
+		}
+		lastSerial = m.Serial
+	}
+}
+
+func TestPersistence_Principals(t *testing.T) {
+	pers, dir := testPersistence(t, strings.Replace(data, "Roles: [MasterAdmin]", "Roles: [MasterAdmin]\n    KeyID: johann@corp\n    Principals: [johann, dba]", 1))
+	if _, err := pers.CompileAndStore(); err != nil {
+		t.Fatalf("CompileAndStore: %s", err)
+	}
+	d, err := ioutil.ReadFile(path.Join(dir, "public", "key", "@johann@corp", "alpha.node.com", "mysql"))
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	lines := strings.Split(string(d), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], ":johann") || !strings.HasSuffix(lines[1], ":dba") {
+		t.Errorf("wrong principal lines: %q", lines)
+	}
+	if _, err := pers.Update(); err != nil {
+		t.Fatalf("Update: %s", err)
+	}
+	if _, err := os.Stat(path.Join(dir, "public", "key", "@johann@corp", "alpha.node.com", "mysql")); err != nil {
+		t.Errorf("principals lost on Update: %s", err)
+	}
+}
+
+func TestPersistence_Revocations(t *testing.T) {
+	pers, dir := testPersistence(t, strings.Replace(data, "Roles: [MasterAdmin]", "Roles: [MasterAdmin]\n    KeyID: johann@corp\n    Principals: [johann]", 1))
+	masterKeyFile := path.Join(dir, "master.key")
+	pers.RevocationFile = path.Join(dir, "revoked.yaml")
+	masterPub, masterPriv, _ := ed25519.GenerateKey(rand.Reader)
+	_ = ioutil.WriteFile(masterKeyFile, []byte(base32.StdEncoding.EncodeToString(masterPriv)+"\n"), 0400)
+	_ = ioutil.WriteFile(pers.RevocationFile, []byte("Users: [Johann]\n"), 0400)
+	if _, err := pers.CompileAndStore(); err != ErrNoMasterKey {
+		t.Errorf("revocations published without master key: %v", err)
+	}
+	pers.MasterKeyFile = masterKeyFile
+	if _, err := pers.CompileAndStore(); err != nil {
+		t.Fatalf("CompileAndStore: %s", err)
+	}
+	list, err := revocation.ReadFile(path.Join(dir, "public", constants.RevocationPath), masterPub)
+	if err != nil {
+		t.Fatalf("revocation.ReadFile: %s", err)
+	}
+	if !list.KeyRevoked("SHA256:RFqtJf2QzWNTc1nh8A1q7giSaFoZSurk5q5uZp91MPM") || !list.KeyRevoked(constants.KeyIDPrefix+"johann@corp") {
+		t.Error("user not expanded to keys and key ID")
+	}
+	d, _ := ioutil.ReadFile(path.Join(dir, "public", "host", "alpha.node.com"))
+	if strings.Contains(string(d), "RFqtJf2QzWNTc1nh8A1q7giSaFoZSurk5q5uZp91MPM") || strings.Contains(string(d), "@johann@corp") {
+		t.Error("revoked user still published")
+	}
+	writeCAKey(t, pers, dir)
+	if _, err := pers.IssueCertificate("Johann", "RFqtJf2QzWNTc1nh8A1q7giSaFoZSurk5q5uZp91MPM", "alpha.node.com", "mysql"); err != ErrRevoked {
+		t.Errorf("certificate for revoked user: %v", err)
+	}
+	serial := list.Serial
+	if _, err := pers.PublishRevocations(); err != nil {
+		t.Fatalf("PublishRevocations: %s", err)
+	}
+	if list, err = revocation.ReadFile(path.Join(dir, "public", constants.RevocationPath), masterPub); err != nil || list.Serial <= serial {
+		t.Errorf("serial not increasing: %v", err)
+	}
+}
+
+func TestKeepGeneration(t *testing.T) {
+	filePath := path.Join(t.TempDir(), "alpha.node.com")
+	_ = ioutil.WriteFile(filePath, []byte("old"), 0600)
+	rolloverPath, err := keepGeneration(filePath, []byte("new"))
+	if err != nil || rolloverPath != filePath+constants.RolloverExtension {
+		t.Fatalf("keepGeneration: %q %v", rolloverPath, err)
+	}
+	if d, err := ioutil.ReadFile(filePath); err != nil || string(d) != "old" {
+		t.Errorf("live file not kept until replaced: %v", err)
+	}
+	if d, err := ioutil.ReadFile(rolloverPath); err != nil || string(d) != "old" {
+		t.Errorf("previous generation not kept: %v", err)
+	}
+	if err := replaceFile(filePath, []byte("new"), 0600); err != nil {
+		t.Fatalf("replaceFile: %s", err)
+	}
+	if d, _ := ioutil.ReadFile(filePath); string(d) != "new" {
+		t.Error("file not replaced")
+	}
+	if d, _ := ioutil.ReadFile(rolloverPath); string(d) != "old" {
+		t.Error("replacing the file changed the previous generation")
+	}
+}
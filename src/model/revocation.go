@@ -0,0 +1,165 @@
+package model
+
+import (
+	"crypto/ed25519"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aurora-is-near/sshaclsrv/src/constants"
+
+	"github.com/aurora-is-near/sshaclsrv/src/revocation"
+
+	"github.com/aurora-is-near/sshaclsrv/src/util"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Revocations is the source of the revocation list.
+type Revocations struct {
+	Fingerprints []string   `yaml:"Fingerprints,omitempty"` // SHA256 fingerprints of user keys.
+	KeyIDs       []string   `yaml:"KeyIDs,omitempty"`       // Certificate key IDs.
+	Subkeys      []string   `yaml:"Subkeys,omitempty"`      // Delegated public keys, base32 or base64 encoded.
+	Users        []UserName `yaml:"Users,omitempty"`        // Users whose keys and key ID are all revoked.
+}
+
+// readRevocations reads the revocation source, or returns nil if none is configured.
+func (persistence *Persistence) readRevocations() (*Revocations, error) {
+	if persistence.RevocationFile == "" {
+		return nil, nil
+	}
+	d, err := ioutil.ReadFile(persistence.RevocationFile)
+	if err != nil {
+		return nil, err
+	}
+	ret := new(Revocations)
+	if err := yaml.UnmarshalStrict(d, ret); err != nil {
+		return nil, fmt.Errorf("%s: %s", persistence.RevocationFile, err)
+	}
+	return ret, nil
+}
+
+func parseSubkey(s string) (ed25519.PublicKey, error) {
+	for _, encoding := range []interface{ DecodeString(string) ([]byte, error) }{base64.StdEncoding, base32.StdEncoding} {
+		if d, err := encoding.DecodeString(strings.TrimSpace(s)); err == nil && len(d) == ed25519.PublicKeySize {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid delegated public key: '%s'", s)
+}
+
+// list expands the revocations into a revocation list. Users are expanded to the keys in their key file and the key
+// IDs of their rows.
+func (revocations *Revocations) list(serial uint64, userDir string, rows CompiledRows) ([]string, *revocation.List, error) {
+	var warnings []string
+	list := revocation.New(serial, time.Now())
+	for _, fingerprint := range revocations.Fingerprints {
+		list.AddKey(fingerprint, "")
+	}
+	for _, keyID := range revocations.KeyIDs {
+		list.AddKeyID(keyID, "")
+	}
+	for _, s := range revocations.Subkeys {
+		subkey, err := parseSubkey(s)
+		if err != nil {
+			return warnings, nil, err
+		}
+		list.AddSubkey(subkey)
+	}
+	keyCache := newKeyCache()
+	for _, user := range revocations.Users {
+		if !validUserName(user) {
+			return warnings, nil, fmt.Errorf("invalid user name '%s' in revocations", user)
+		}
+		keys, err := keyCache.getKeys(userDir, user)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("Failed to get keys of revoked user '%s': %s", user, err))
+		}
+		for _, key := range keys {
+			list.AddKey(key.Fingerprint, string(user))
+		}
+		for _, row := range rows {
+			if row.User == user && row.KeyID != "" {
+				list.AddKeyID(row.KeyID, string(user))
+			}
+		}
+	}
+	return warnings, list, nil
+}
+
+// revokes returns true if the revocations name the user or the key fingerprint.
+func (revocations *Revocations) revokes(user UserName, fingerprint string) bool {
+	if revocations == nil {
+		return false
+	}
+	for _, u := range revocations.Users {
+		if u == user {
+			return true
+		}
+	}
+	for _, f := range revocations.Fingerprints {
+		if strings.TrimPrefix(f, "SHA256:") == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// publishRevocations signs the revocation list with the master key and writes it to BaseDir. It returns the list, or
+// nil if revocations are not configured.
+func (persistence *Persistence) publishRevocations(rows CompiledRows) ([]string, *revocation.List, error) {
+	revocations, err := persistence.readRevocations()
+	if err != nil || revocations == nil {
+		return nil, nil, err
+	}
+	if persistence.MasterKeyFile == "" {
+		return nil, nil, ErrNoMasterKey
+	}
+	l, err := util.ReadFile(persistence.MasterKeyFile)
+	if err != nil || len(l) != 1 || len(l[0]) != ed25519.PrivateKeySize {
+		return nil, nil, fmt.Errorf("cannot read master key %s: %v", persistence.MasterKeyFile, err)
+	}
+	serial, err := persistence.nextSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	warnings, list, err := revocations.list(serial, persistence.UserDir, rows)
+	if err != nil {
+		return warnings, nil, err
+	}
+	if err := os.MkdirAll(persistence.BaseDir, 0700); err != nil {
+		return warnings, nil, err
+	}
+	filename := path.Join(persistence.BaseDir, constants.RevocationPath)
+	tmpFile := fmt.Sprintf("%s.tmp-%d", filename, time.Now().UnixNano())
+	if err := writeFile(tmpFile, list.Sign(l[0]), 0600); err != nil {
+		_ = os.Remove(tmpFile)
+		return warnings, nil, err
+	}
+	if err := os.Rename(tmpFile, filename); err != nil {
+		_ = os.Remove(tmpFile)
+		return warnings, nil, err
+	}
+	return warnings, list, nil
+}
+
+// PublishRevocations publishes the revocation list without updating keys.
+func (persistence *Persistence) PublishRevocations() ([]string, error) {
+	if err := persistence.initSign(); err != nil {
+		return nil, err
+	}
+	if persistence.RevocationFile == "" {
+		return nil, ErrNoRevocations
+	}
+	rows, err := persistence.loadRows()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	warnings, _, err := persistence.publishRevocations(rows)
+	return warnings, err
+}
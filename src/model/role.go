@@ -1,19 +1,49 @@
 package model
 
+import "net"
+
 // Role specifies a list of actions assigned to a user.
 type Role struct {
-	Actions    []ActionName
-	servers    []*Server
-	role       RoleName
-	serverDesc ServerMatch
+	Actions []ActionName
+	// SourceNetworks restricts the client address to a list of CIDR prefixes or addresses.
+	SourceNetworks []string
+	// Window restricts access to a recurring period of time.
+	Window string
+	// Selector restricts the servers to those whose labels match a label selector, like "env=prod,tier!=web".
+	Selector string
+	// Roles are included with all their actions, restricted to the servers and other restrictions of this entry.
+	Roles []RoleName
+
+	servers        []*Server
+	role           RoleName
+	serverDesc     ServerMatch
+	sourceNetworks []*net.IPNet
+	selector       selector
 }
 
-// UnmarshalYAML parses YAML into Role.
+// UnmarshalYAML parses YAML into Role, either a list of actions or a mapping with Actions, included Roles and
+// restrictions.
 func (serverAction *Role) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var tmp []ActionName
-	if err := unmarshal(&tmp); err != nil {
+	if err := unmarshal(&tmp); err == nil {
+		serverAction.Actions = tmp
+		return nil
+	}
+	type RoleT struct {
+		Actions        []ActionName `yaml:"Actions"`
+		SourceNetworks []string     `yaml:"SourceNetworks"`
+		Window         string       `yaml:"Window"`
+		Selector       string       `yaml:"Selector"`
+		Roles          []RoleName   `yaml:"Roles"`
+	}
+	var tmpRole RoleT
+	if err := unmarshal(&tmpRole); err != nil {
 		return err
 	}
-	serverAction.Actions = tmp
+	serverAction.Actions = tmpRole.Actions
+	serverAction.SourceNetworks = tmpRole.SourceNetworks
+	serverAction.Window = tmpRole.Window
+	serverAction.Selector = tmpRole.Selector
+	serverAction.Roles = tmpRole.Roles
 	return nil
 }
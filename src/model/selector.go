@@ -0,0 +1,84 @@
+package model
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	selectorDelim  = ","
+	selectorEqual  = "="
+	selectorNotEq  = "!="
+	selectorAbsent = "!"
+)
+
+var (
+	// ErrSelector is returned for label selectors that cannot be parsed.
+	ErrSelector = errors.New("invalid label selector")
+)
+
+// requirement is a single condition of a selector on one label.
+type requirement struct {
+	key    string
+	value  string
+	exists bool // Only test whether the label exists.
+	negate bool
+}
+
+func (r requirement) matches(labels map[string]string) bool {
+	value, ok := labels[r.key]
+	if !r.exists {
+		ok = ok && value == r.value
+	}
+	return ok != r.negate
+}
+
+// selector is a list of requirements that all must be met by the labels of a server.
+type selector []requirement
+
+// isSelector returns true if a ServerMatch is a label selector instead of a list of hostmatch patterns. Hostnames
+// cannot contain '='.
+func isSelector(s string) bool {
+	return strings.Contains(s, selectorEqual)
+}
+
+func validLabel(s string) bool {
+	return s != "" && !strings.ContainsAny(s, ",=!:/\\ \t\n")
+}
+
+// parseSelector parses a comma separated list of requirements: key=value, key!=value, key (label exists) and !key
+// (label does not exist).
+func parseSelector(s string) (selector, error) {
+	var ret selector
+	for _, e := range strings.Split(s, selectorDelim) {
+		var r requirement
+		e = strings.TrimSpace(e)
+		switch {
+		case strings.Contains(e, selectorNotEq):
+			p := strings.SplitN(e, selectorNotEq, 2)
+			r = requirement{key: strings.TrimSpace(p[0]), value: strings.TrimSpace(p[1]), negate: true}
+		case strings.Contains(e, selectorEqual):
+			p := strings.SplitN(e, selectorEqual, 2)
+			r = requirement{key: strings.TrimSpace(p[0]), value: strings.TrimSpace(p[1])}
+		case strings.HasPrefix(e, selectorAbsent):
+			r = requirement{key: strings.TrimSpace(e[1:]), exists: true, negate: true}
+		default:
+			r = requirement{key: e, exists: true}
+		}
+		if !validLabel(r.key) || (!r.exists && !validLabel(r.value)) {
+			return nil, ErrSelector
+		}
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
+
+// matches returns true if the labels meet all requirements. An empty selector matches all servers.
+func (sel selector) matches(labels map[string]string) bool {
+	for _, r := range sel {
+		if !r.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
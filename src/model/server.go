@@ -3,16 +3,28 @@ package model
 // Server is a server within the authenticated domain.
 type Server struct {
 	// Actions are actions that are available on the server.
-	Actions    []ActionName
+	Actions []ActionName
+	// Labels are key/value pairs, like env=prod, that roles can select servers by.
+	Labels     map[string]string
 	servername ServerName
 }
 
-// UnmarshalYAML parses YAML into Server.
+// UnmarshalYAML parses YAML into Server, either a list of actions or a mapping with Actions and Labels.
 func (server *Server) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var tmp []ActionName
-	if err := unmarshal(&tmp); err != nil {
+	if err := unmarshal(&tmp); err == nil {
+		server.Actions = tmp
+		return nil
+	}
+	type ServerT struct {
+		Actions []ActionName      `yaml:"Actions"`
+		Labels  map[string]string `yaml:"Labels"`
+	}
+	var tmpServer ServerT
+	if err := unmarshal(&tmpServer); err != nil {
 		return err
 	}
-	server.Actions = tmp
+	server.Actions = tmpServer.Actions
+	server.Labels = tmpServer.Labels
 	return nil
 }
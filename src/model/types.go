@@ -1,12 +1,23 @@
 package model
 
-import "errors"
+import (
+	"errors"
+	"strings"
+
+	"github.com/aurora-is-near/sshaclsrv/src/constants"
+
+	"github.com/aurora-is-near/sshaclsrv/src/hostmatch"
+)
 
 var (
 	// ErrShortPath is returned when trying to clean up a directory structure that is not deep enough.
 	ErrShortPath = errors.New("refusing to operate on a short path")
 	// ErrBaseDir is returned if the baseDir is wrongly configured.
 	ErrBaseDir = errors.New("baseDir must be the prefix of perKeyDir and perUserDir")
+	// ErrNoRevocations is returned if revocations are published without RevocationFile.
+	ErrNoRevocations = errors.New("no revocation file configured")
+	// ErrNoMasterKey is returned if revocations are configured without MasterKeyFile.
+	ErrNoMasterKey = errors.New("revocations require a master key file")
 )
 
 // ServerName is the name of a server. FQDN.
@@ -21,16 +32,24 @@ type UserName string
 // RoleName is a role that refers to a collection of available actions.
 type RoleName string
 
-// ServerMatch is a glob pattern to match one or more servers.
+// ServerMatch is a comma separated list of hostmatch patterns to match one or more servers. Patterns prefixed with
+// '!' exclude servers. A ServerMatch that contains '=' is a label selector instead, like "env=prod,tier=db".
 type ServerMatch string
 
-// SystemUserName refers to a system user on a node.
+// SystemUserName refers to a system user on a node. It can also be a hostmatch pattern or a reference to a Unix group
+// of the node ("@<group>"), which are resolved by the node.
 type SystemUserName string
 
+// isPattern returns true if the name is a pattern or group reference instead of a single system user.
+func (user SystemUserName) isPattern() bool {
+	return strings.HasPrefix(string(user), constants.GroupPrefix) || hostmatch.IsPattern(string(user))
+}
+
 // SystemACL is the model from which to generate permission rows.
 type SystemACL struct {
 	Servers map[ServerName]*Server             `yaml:"Servers"`
 	Actions map[ActionName]*Action             `yaml:"Actions"`
 	Users   map[UserName]*User                 `yaml:"Users"`
 	Roles   map[RoleName]map[ServerMatch]*Role `yaml:"Roles"`
+	Groups  map[GroupName]*Group               `yaml:"Groups"`
 }
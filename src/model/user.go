@@ -1,6 +1,7 @@
 package model
 
 import (
+	"sort"
 	"time"
 
 	"github.com/aurora-is-near/sshaclsrv/src/stringduration"
@@ -9,19 +10,32 @@ import (
 // User is an organization user/person.
 type User struct {
 	name UserName
+	// NotBefore prevents authentication of the user before a date.
+	NotBefore time.Time `yaml:"NotBefore"`
 	// NotAfter prevents authentication of the user after a date.
 	NotAfter time.Time `yaml:"NotAfter"`
 	// Expire enforces expiration for authenticated keys.
 	Expire time.Duration `yaml:"Expire"`
 	Roles  []RoleName    `yaml:"Roles"`
+	// Grants are roles that are only assigned during a period of time.
+	Grants []Grant `yaml:"Grants"`
+	// KeyID is the key ID of the user's SSH certificates. If set, principals are issued for the user.
+	KeyID string `yaml:"KeyID"`
+	// Principals are issued for certificate logins, defaults to the user's name.
+	Principals []string `yaml:"Principals"`
 }
 
 // UnmarshalYAML parses YAML into User.
 func (user *User) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var err error
 	type UserT struct {
-		Expire string     `yaml:"Expire"`
-		Roles  []RoleName `yaml:"Roles"`
+		NotBefore  time.Time  `yaml:"NotBefore"`
+		NotAfter   time.Time  `yaml:"NotAfter"`
+		Expire     string     `yaml:"Expire"`
+		Roles      []RoleName `yaml:"Roles"`
+		Grants     []Grant    `yaml:"Grants"`
+		KeyID      string     `yaml:"KeyID"`
+		Principals []string   `yaml:"Principals"`
 	}
 	var tmp UserT
 	if err := unmarshal(&tmp); err != nil {
@@ -30,6 +44,68 @@ func (user *User) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if user.Expire, err = stringduration.Parse(tmp.Expire); err != nil {
 		return err
 	}
+	user.NotBefore = tmp.NotBefore
+	user.NotAfter = tmp.NotAfter
 	user.Roles = tmp.Roles
+	user.Grants = tmp.Grants
+	user.KeyID = tmp.KeyID
+	user.Principals = tmp.Principals
 	return nil
 }
+
+// Grant assigns a role to a user for a period of time.
+type Grant struct {
+	Role RoleName `yaml:"Role"`
+	// NotBefore is the start of the assignment, immediately if zero.
+	NotBefore time.Time `yaml:"NotBefore"`
+	// NotAfter is the end of the assignment, unlimited if zero.
+	NotAfter time.Time `yaml:"NotAfter"`
+	// Window restricts the assignment to a recurring period of time.
+	Window string `yaml:"Window"`
+
+	expire time.Duration // Limits the expiration of keys, for grants through groups.
+}
+
+// grants returns all role assignments of the user, including those through groups, limited by the user's own
+// validity. Each assignment is returned once.
+func (user *User) grants(groupGrants ...Grant) []Grant {
+	ret := make([]Grant, 0, len(user.Roles)+len(user.Grants)+len(groupGrants))
+	for _, role := range user.Roles {
+		ret = append(ret, Grant{Role: role, NotBefore: user.NotBefore, NotAfter: user.NotAfter})
+	}
+	all := make([]Grant, 0, len(user.Grants)+len(groupGrants))
+	all = append(append(all, user.Grants...), groupGrants...)
+	for _, grant := range all {
+		if user.NotBefore.After(grant.NotBefore) {
+			grant.NotBefore = user.NotBefore
+		}
+		tl := TimeList{grant.NotAfter, user.NotAfter}
+		sort.Sort(tl)
+		grant.NotAfter = tl[0]
+		ret = append(ret, grant)
+	}
+	return uniqueGrants(ret)
+}
+
+// uniqueGrants removes repeated grants, as they result from overlapping or nested group memberships.
+func uniqueGrants(grants []Grant) []Grant {
+	seen := make(map[Grant]bool, len(grants))
+	ret := grants[:0]
+	for _, grant := range grants {
+		key := grant
+		key.NotBefore, key.NotAfter = grant.NotBefore.UTC(), grant.NotAfter.UTC()
+		if !seen[key] {
+			seen[key] = true
+			ret = append(ret, grant)
+		}
+	}
+	return ret
+}
+
+// expired returns true if the grant has ended, or can never start.
+func (grant Grant) expired(now time.Time) bool {
+	if grant.NotAfter.IsZero() {
+		return false
+	}
+	return grant.NotAfter.Before(now) || grant.NotAfter.Before(grant.NotBefore)
+}
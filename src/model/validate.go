@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/aurora-is-near/sshaclsrv/src/constants"
+
 	"github.com/aurora-is-near/sshaclsrv/src/sshkey"
 
 	"github.com/aurora-is-near/sshaclsrv/src/hostmatch"
@@ -18,7 +20,42 @@ func validUserName(user UserName) bool {
 }
 
 func validSystemUserName(user SystemUserName) bool {
-	return !strings.ContainsAny(string(user), "/\\:")
+	if group := strings.TrimPrefix(string(user), constants.GroupPrefix); group != string(user) {
+		return group != "" && !strings.ContainsAny(group, "/\\:@, \t\n") && !hostmatch.IsPattern(group)
+	}
+	if strings.ContainsAny(string(user), "/\\:") {
+		return false
+	}
+	if hostmatch.IsPattern(string(user)) {
+		_, err := hostmatch.Parse(string(user))
+		return err == nil
+	}
+	return true
+}
+
+func validKeyID(keyID string) bool {
+	return keyID != "" && keyID[0] != '.' && !strings.ContainsAny(keyID, "/\\: \t\n")
+}
+
+func validPrincipal(principal string) bool {
+	return principal != "" && !strings.ContainsAny(principal, ":, \t\n")
+}
+
+func validWindow(window string) bool {
+	if window == "" {
+		return true
+	}
+	_, err := sshkey.ParseWindow(window)
+	return err == nil
+}
+
+func hasOption(options sshkey.Options, key string) bool {
+	for _, option := range options {
+		if option.Key == key {
+			return true
+		}
+	}
+	return false
 }
 
 func (acl *SystemACL) validate() error {
@@ -28,6 +65,11 @@ func (acl *SystemACL) validate() error {
 			return fmt.Errorf("server '%s' contains illegal characters", server)
 		}
 		actions.servername = server
+		for key, value := range actions.Labels {
+			if !validLabel(key) || !validLabel(value) {
+				return fmt.Errorf("server '%s' has label '%s=%s' with illegal characters", server, key, value)
+			}
+		}
 		for _, action := range actions.Actions {
 			if _, ok := acl.Actions[action]; !ok {
 				return fmt.Errorf("server '%s' references unknown action '%s'", server, action)
@@ -38,11 +80,20 @@ func (acl *SystemACL) validate() error {
 		var err error
 		action.name = name
 		if !validSystemUserName(action.User) {
-			return fmt.Errorf("action '%s' contains systemuser '%s' with illegal characters", action.name, action.User)
+			return fmt.Errorf("action '%s' contains systemuser '%s' with illegal characters or invalid group", action.name, action.User)
 		}
 		if action.sshoptions, err = sshkey.ParseOptions(action.Options); err != nil {
 			return fmt.Errorf("Action '%s' contains invalid options '%s'. %s", action.name, action.Options, err)
 		}
+		if action.sourceNetworks, err = sshkey.ParseNetworks(action.SourceNetworks); err != nil {
+			return fmt.Errorf("action '%s' contains invalid source networks %v", action.name, action.SourceNetworks)
+		}
+		if len(action.sourceNetworks) > 0 && hasOption(action.sshoptions, "from") {
+			return fmt.Errorf("action '%s' contains both source networks and a from option", action.name)
+		}
+		if !validWindow(action.Window) {
+			return fmt.Errorf("action '%s' contains invalid window '%s'", action.name, action.Window)
+		}
 		if _, ok := systemusers[action.User]; ok {
 			return fmt.Errorf("action '%s' contains duplicate systemuser '%s'", name, action.User)
 		}
@@ -58,11 +109,51 @@ func (acl *SystemACL) validate() error {
 				return fmt.Errorf("user '%s' references unknown role '%s'", name, role)
 			}
 		}
+		for _, grant := range user.Grants {
+			if _, ok := acl.Roles[grant.Role]; !ok {
+				return fmt.Errorf("user '%s' has grant of unknown role '%s'", name, grant.Role)
+			}
+			if !validWindow(grant.Window) {
+				return fmt.Errorf("user '%s' has grant of role '%s' with invalid window '%s'", name, grant.Role, grant.Window)
+			}
+		}
+		if user.KeyID != "" && !validKeyID(user.KeyID) {
+			return fmt.Errorf("user '%s' has key ID '%s' with illegal characters", name, user.KeyID)
+		}
+		for _, principal := range user.Principals {
+			if !validPrincipal(principal) {
+				return fmt.Errorf("user '%s' has principal '%s' with illegal characters", name, principal)
+			}
+		}
 	}
 	for rolename, server := range acl.Roles {
 		for serverdesc, actions := range server {
+			var err error
 			actions.role = rolename
 			actions.serverDesc = serverdesc
+			actions.selector = nil
+			if isSelector(string(serverdesc)) {
+				if actions.selector, err = parseSelector(string(serverdesc)); err != nil {
+					return fmt.Errorf("role '%s' contains invalid label selector '%s'", rolename, serverdesc)
+				}
+			} else if _, err := hostmatch.ParseList(string(serverdesc)); err != nil {
+				return fmt.Errorf("role '%s' contains invalid server pattern '%s'", rolename, serverdesc)
+			} else if strings.Contains(string(serverdesc), ":") {
+				return fmt.Errorf("role '%s' contains server pattern '%s' with IPv6 addresses, which cannot name servers", rolename, serverdesc)
+			}
+			if actions.Selector != "" {
+				sel, err := parseSelector(actions.Selector)
+				if err != nil {
+					return fmt.Errorf("role '%s', server '%s' contains invalid label selector '%s'", rolename, serverdesc, actions.Selector)
+				}
+				actions.selector = append(actions.selector, sel...)
+			}
+			if actions.sourceNetworks, err = sshkey.ParseNetworks(actions.SourceNetworks); err != nil {
+				return fmt.Errorf("role '%s', server '%s' contains invalid source networks %v", rolename, serverdesc, actions.SourceNetworks)
+			}
+			if !validWindow(actions.Window) {
+				return fmt.Errorf("role '%s', server '%s' contains invalid window '%s'", rolename, serverdesc, actions.Window)
+			}
 			for _, action := range actions.Actions {
 				if _, ok := acl.Actions[action]; !ok {
 					return fmt.Errorf("role '%s', server '%s' references unknown action '%s'", rolename, serverdesc, action)
@@ -70,35 +161,59 @@ func (acl *SystemACL) validate() error {
 			}
 		}
 	}
-	return nil
+	if err := acl.checkIncludes(); err != nil {
+		return err
+	}
+	return acl.validateGroups()
 }
 
 func (acl *SystemACL) warnings() []string {
 	ret := make([]string, 0, 10)
 	servers := make([]*Server, 0, len(acl.Servers))
+	names := make([]string, 0, len(acl.Servers))
 	for _, server := range acl.Servers {
 		servers = append(servers, server)
+		names = append(names, string(server.servername))
+	}
+	set := hostmatch.NewSet()
+	serverdescList := make(map[ServerMatch]int)
+	for _, serversList := range acl.Roles {
+		for serverdesc := range serversList {
+			if _, ok := serverdescList[serverdesc]; ok || isSelector(string(serverdesc)) {
+				continue
+			}
+			pat, _ := hostmatch.ParseList(string(serverdesc))
+			serverdescList[serverdesc] = set.Add(pat)
+		}
 	}
-	serverdescList := make(map[ServerMatch][]*Server)
+	hosts := set.Hosts(names)
 	for rolename, serversList := range acl.Roles {
 		for serverdesc, serverDescA := range serversList {
-			if serverList, ok := serverdescList[serverdesc]; ok {
-				serverDescA.servers = serverList
-			} else {
-				matches := make([]*Server, 0, 10)
-				pat := hostmatch.Compile(string(serverdesc))
-				for _, server := range servers {
-					if pat.Match(string(server.servername)) {
+			candidates := servers
+			if idx, ok := serverdescList[serverdesc]; ok {
+				candidates = make([]*Server, len(hosts[idx]))
+				for i, host := range hosts[idx] {
+					candidates[i] = servers[host]
+				}
+			}
+			matches := candidates
+			if len(serverDescA.selector) > 0 {
+				matches = make([]*Server, 0, 10)
+				for _, server := range candidates {
+					if serverDescA.selector.matches(server.Labels) {
 						matches = append(matches, server)
 					}
 				}
-				serverdescList[serverdesc] = matches
-				serverDescA.servers = matches
 			}
-			if len(serverDescA.servers) == 0 {
+			if serverDescA.servers = matches; len(matches) > 0 {
+				continue
+			}
+			if serverDescA.Selector != "" {
+				ret = append(ret, fmt.Sprintf("role '%s',serverdesc '%s' with selector '%s' does not match any servers", rolename, serverdesc, serverDescA.Selector))
+			} else {
 				ret = append(ret, fmt.Sprintf("role '%s',serverdesc '%s' does not match any servers", rolename, serverdesc))
 			}
 		}
 	}
-	return nil
+	return ret
 }
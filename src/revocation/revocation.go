@@ -0,0 +1,203 @@
+// Package revocation implements lists of revoked keys, certificate key IDs and delegated subkeys. Lists are signed by
+// the master key, so that a compromised delegated subkey can neither revoke nor un-revoke anything.
+//
+// Format:
+//
+//	SSHACLREVOKE1 <serial> <generated>
+//	key <sha256_of_key> [<user>]
+//	keyid <certificate key ID> [<user>]
+//	subkey <base64 delegated public key>
+//	sig <base64 ed25519 signature of all previous lines by the master key>
+package revocation
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aurora-is-near/sshaclsrv/src/constants"
+
+	"github.com/aurora-is-near/sshaclsrv/src/fileperm"
+)
+
+const (
+	magic      = "SSHACLREVOKE1"
+	timeFormat = "20060102150405"
+
+	recordKey    = "key"
+	recordKeyID  = "keyid"
+	recordSubkey = "subkey"
+	recordSig    = "sig"
+
+	fingerprintPrefix = "SHA256:"
+)
+
+var (
+	// ErrFormat is returned if a list cannot be parsed.
+	ErrFormat = errors.New("revocation: invalid format")
+	// ErrSignature is returned if a list is not signed by the master key.
+	ErrSignature = errors.New("revocation: invalid signature")
+)
+
+// List is a list of revocations.
+type List struct {
+	Serial    uint64    // Monotonically increasing serial.
+	Generated time.Time // Time of generation.
+
+	keys    map[string]string // Fingerprints and KeyIDPrefix + key IDs, to the user they belonged to.
+	subkeys map[string]bool   // Base64 encoded delegated public keys.
+}
+
+// New returns an empty list.
+func New(serial uint64, generated time.Time) *List {
+	return &List{
+		Serial:    serial,
+		Generated: generated,
+		keys:      make(map[string]string),
+		subkeys:   make(map[string]bool),
+	}
+}
+
+// AddKey revokes the key with fingerprint, which belonged to user (optional).
+func (list *List) AddKey(fingerprint, user string) {
+	list.keys[strings.TrimPrefix(fingerprint, fingerprintPrefix)] = user
+}
+
+// AddKeyID revokes the certificate key ID, which belonged to user (optional).
+func (list *List) AddKeyID(keyID, user string) {
+	list.keys[constants.KeyIDPrefix+keyID] = user
+}
+
+// AddSubkey revokes a delegated subkey.
+func (list *List) AddSubkey(publicKey ed25519.PublicKey) {
+	list.subkeys[base64.StdEncoding.EncodeToString(publicKey)] = true
+}
+
+// KeyRevoked returns true if the fingerprint, or the key ID prefixed with KeyIDPrefix, is revoked. A nil list revokes
+// nothing.
+func (list *List) KeyRevoked(fingerprint string) bool {
+	if list == nil {
+		return false
+	}
+	_, ok := list.keys[strings.TrimPrefix(fingerprint, fingerprintPrefix)]
+	return ok
+}
+
+// SubkeyRevoked returns true if the delegated subkey is revoked. A nil list revokes nothing.
+func (list *List) SubkeyRevoked(publicKey ed25519.PublicKey) bool {
+	return list != nil && list.subkeys[base64.StdEncoding.EncodeToString(publicKey)]
+}
+
+// Len returns the number of revocations.
+func (list *List) Len() int {
+	return len(list.keys) + len(list.subkeys)
+}
+
+func (list *List) body() []byte {
+	buf := new(bytes.Buffer)
+	_, _ = fmt.Fprintf(buf, "%s %d %s\n", magic, list.Serial, list.Generated.UTC().Format(timeFormat))
+	lines := make([]string, 0, list.Len())
+	for key, user := range list.keys {
+		record := recordKey
+		if strings.HasPrefix(key, constants.KeyIDPrefix) {
+			record, key = recordKeyID, key[len(constants.KeyIDPrefix):]
+		}
+		lines = append(lines, strings.TrimSpace(strings.Join([]string{record, key, user}, " ")))
+	}
+	for subkey := range list.subkeys {
+		lines = append(lines, recordSubkey+" "+subkey)
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		_, _ = fmt.Fprintln(buf, line)
+	}
+	return buf.Bytes()
+}
+
+// Sign returns the list, signed with the master key.
+func (list *List) Sign(masterKey ed25519.PrivateKey) []byte {
+	body := list.body()
+	sig := ed25519.Sign(masterKey, body)
+	return append(body, []byte(recordSig+" "+base64.StdEncoding.EncodeToString(sig)+"\n")...)
+}
+
+// Parse verifies the signature of a list by the master public key and parses it.
+func Parse(d []byte, masterKey ed25519.PublicKey) (*List, error) {
+	p := bytes.LastIndex(bytes.TrimRight(d, "\n"), []byte("\n"+recordSig+" "))
+	if p < 0 {
+		return nil, ErrFormat
+	}
+	body, sigLine := d[:p+1], strings.TrimSpace(string(d[p+1:]))
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(sigLine, recordSig+" "))
+	if err != nil || len(masterKey) != ed25519.PublicKeySize || !ed25519.Verify(masterKey, body, sig) {
+		return nil, ErrSignature
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	if !scanner.Scan() {
+		return nil, ErrFormat
+	}
+	f := strings.Fields(scanner.Text())
+	if len(f) != 3 || f[0] != magic {
+		return nil, ErrFormat
+	}
+	serial, err := strconv.ParseUint(f[1], 10, 64)
+	if err != nil {
+		return nil, ErrFormat
+	}
+	generated, err := time.Parse(timeFormat, f[2])
+	if err != nil {
+		return nil, ErrFormat
+	}
+	list := New(serial, generated)
+	for scanner.Scan() {
+		f := strings.Fields(scanner.Text())
+		if len(f) == 0 {
+			continue
+		}
+		var user string
+		if len(f) > 2 {
+			user = f[2]
+		}
+		switch {
+		case f[0] == recordKey && len(f) >= 2:
+			list.AddKey(f[1], user)
+		case f[0] == recordKeyID && len(f) >= 2:
+			list.AddKeyID(f[1], user)
+		case f[0] == recordSubkey && len(f) == 2:
+			subkey, err := base64.StdEncoding.DecodeString(f[1])
+			if err != nil || len(subkey) != ed25519.PublicKeySize {
+				return nil, ErrFormat
+			}
+			list.AddSubkey(subkey)
+		default:
+			return nil, ErrFormat
+		}
+	}
+	return list, nil
+}
+
+// ReadFile reads and verifies a list from a file that passes the permission check.
+func ReadFile(filename string, masterKey ed25519.PublicKey) (*List, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	if err := fileperm.PermissionCheck(f); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	d, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(d, masterKey)
+}
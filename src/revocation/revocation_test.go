@@ -0,0 +1,45 @@
+package revocation
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func TestList(t *testing.T) {
+	masterPub, masterPriv, _ := ed25519.GenerateKey(rand.Reader)
+	subPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	list := New(1633000000, time.Now())
+	list.AddKey("SHA256:rRaqTcTR3GVRW3jvYodpYXR6VJlmJXL4JQO8iHeB9Kg", "Johann")
+	list.AddKeyID("johann", "Johann")
+	list.AddSubkey(subPub)
+	d := list.Sign(masterPriv)
+	p, err := Parse(d, masterPub)
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	if p.Serial != list.Serial || p.Generated.Unix() != list.Generated.Unix() || p.Len() != 3 {
+		t.Error("list corrupted")
+	}
+	if !p.KeyRevoked("rRaqTcTR3GVRW3jvYodpYXR6VJlmJXL4JQO8iHeB9Kg") || !p.KeyRevoked("@johann") || !p.SubkeyRevoked(subPub) {
+		t.Error("revocation lost")
+	}
+	if p.KeyRevoked("johann") || p.SubkeyRevoked(masterPub) {
+		t.Error("revoked too much")
+	}
+	var empty *List
+	if empty.KeyRevoked("@johann") || empty.SubkeyRevoked(subPub) {
+		t.Error("nil list revokes")
+	}
+	if _, err := Parse(bytes.Replace(d, []byte("johann"), []byte("jordan"), 1), masterPub); err != ErrSignature {
+		t.Errorf("modification not detected: %v", err)
+	}
+	if _, err := Parse(d[:bytes.Index(d, []byte("sig "))], masterPub); err != ErrFormat {
+		t.Errorf("missing signature not detected: %v", err)
+	}
+	if _, err := Parse(d, subPub); err != ErrSignature {
+		t.Errorf("wrong key accepted: %v", err)
+	}
+}
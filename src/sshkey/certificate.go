@@ -0,0 +1,48 @@
+package sshkey
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrCertificateOption is returned for options that cannot be expressed in an OpenSSH certificate.
+var ErrCertificateOption = errors.New("option not supported in certificates")
+
+var defaultExtensions = []string{"permit-X11-forwarding", "permit-agent-forwarding", "permit-port-forwarding", "permit-pty", "permit-user-rc"}
+
+// Permissions returns the critical options and extensions of an OpenSSH user certificate that grants the same access
+// as options do for an authorized key. Options that would widen access if dropped are refused with
+// ErrCertificateOption.
+func (options Options) Permissions() (*ssh.Permissions, error) {
+	perms := &ssh.Permissions{
+		CriticalOptions: make(map[string]string),
+		Extensions:      make(map[string]string),
+	}
+	opts := options.toMap()
+	if _, ok := opts["restrict"]; !ok {
+		for _, extension := range defaultExtensions {
+			perms.Extensions[extension] = ""
+		}
+	}
+	for _, opt := range options {
+		switch opt.Key {
+		case "command":
+			perms.CriticalOptions["force-command"] = opt.Value.String()
+		case "from":
+			perms.CriticalOptions["source-address"] = opt.Value.String()
+		case "verify-required":
+			perms.CriticalOptions["verify-required"] = ""
+		case "no-touch-required":
+			perms.Extensions["no-touch-required"] = ""
+		case "agent-forwarding", "port-forwarding", "pty", "user-rc", "X11-forwarding":
+			perms.Extensions["permit-"+opt.Key] = ""
+		case "no-agent-forwarding", "no-port-forwarding", "no-pty", "no-user-rc", "no-X11-forwarding":
+			delete(perms.Extensions, "permit-"+opt.Key[len("no-"):])
+		case "restrict", "expiry-time":
+		default:
+			return nil, ErrCertificateOption
+		}
+	}
+	return perms, nil
+}
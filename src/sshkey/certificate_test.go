@@ -0,0 +1,26 @@
+package sshkey
+
+import (
+	"testing"
+)
+
+func TestPermissions(t *testing.T) {
+	options, err := ParseOptions(`restrict pty command="/bin/true" from="10.0.0.0/8"`)
+	if err != nil {
+		t.Fatalf("ParseOptions: %s", err)
+	}
+	perms, err := options.Permissions()
+	if err != nil {
+		t.Fatalf("Permissions: %s", err)
+	}
+	if len(perms.Extensions) != 1 || perms.CriticalOptions["force-command"] != "/bin/true" || perms.CriticalOptions["source-address"] != "10.0.0.0/8" {
+		t.Errorf("wrong permissions: %v", perms)
+	}
+	if _, ok := perms.Extensions["permit-pty"]; !ok {
+		t.Error("pty not permitted")
+	}
+	options, _ = ParseOptions(`permitopen="127.0.0.1:80"`)
+	if _, err := options.Permissions(); err != ErrCertificateOption {
+		t.Errorf("permitopen must be refused: %v", err)
+	}
+}
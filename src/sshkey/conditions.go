@@ -0,0 +1,163 @@
+package sshkey
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aurora-is-near/sshaclsrv/src/hostmatch"
+)
+
+const (
+	// ConditionsDelim separates the conditions of an entry from its validity.
+	ConditionsDelim = "?"
+
+	conditionSource = "from"
+	conditionWindow = "window"
+	networkDelim    = ","
+)
+
+var (
+	// ErrCondition is returned for unknown or malformed conditions.
+	ErrCondition = errors.New("invalid condition")
+)
+
+// Conditions restrict an entry beyond its validity. They are appended to the validity field of entries as URL query,
+// so that parsers without support for them treat the entry as expired.
+type Conditions struct {
+	// SourceNetworks restrict the client address, if not empty.
+	SourceNetworks []*net.IPNet
+	// Windows restrict the time of access. Access is only allowed while all windows are open.
+	Windows []*Window
+}
+
+// String returns the encoded conditions, prefixed with ConditionsDelim, or an empty string if there are none.
+func (conditions Conditions) String() string {
+	v := make(url.Values)
+	if len(conditions.SourceNetworks) > 0 {
+		v.Set(conditionSource, NetworksToString(conditions.SourceNetworks))
+	}
+	for _, w := range conditions.Windows {
+		v.Add(conditionWindow, w.String())
+	}
+	if len(v) == 0 {
+		return ""
+	}
+	return ConditionsDelim + v.Encode()
+}
+
+// ParseConditions parses encoded conditions without the leading ConditionsDelim.
+func ParseConditions(s string) (conditions Conditions, err error) {
+	v, err := url.ParseQuery(s)
+	if err != nil {
+		return conditions, ErrCondition
+	}
+	for key, values := range v {
+		switch key {
+		case conditionSource:
+			if len(values) != 1 {
+				return conditions, ErrCondition
+			}
+			if conditions.SourceNetworks, err = ParseNetworks(strings.Split(values[0], networkDelim)); err != nil {
+				return conditions, err
+			}
+		case conditionWindow:
+			for _, value := range values {
+				w, err := ParseWindow(value)
+				if err != nil {
+					return conditions, err
+				}
+				conditions.Windows = append(conditions.Windows, w)
+			}
+		default:
+			return conditions, ErrCondition
+		}
+	}
+	return conditions, nil
+}
+
+// Open returns true if all windows of the conditions contain t.
+func (conditions Conditions) Open(t time.Time) bool {
+	for _, w := range conditions.Windows {
+		if !w.Contains(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// SplitConditions splits a validity field into the validity and the encoded conditions.
+func SplitConditions(field string) (validity, conditions string) {
+	if p := strings.Index(field, ConditionsDelim); p >= 0 {
+		return field[:p], field[p+len(ConditionsDelim):]
+	}
+	return field, ""
+}
+
+// ParseNetworks parses a list of CIDR prefixes or single addresses.
+func ParseNetworks(networks []string) ([]*net.IPNet, error) {
+	ret := make([]*net.IPNet, 0, len(networks))
+	for _, network := range networks {
+		n, err := hostmatch.ParseNetwork(network)
+		if err != nil || n == nil {
+			return nil, ErrCondition
+		}
+		ret = append(ret, n)
+	}
+	return ret, nil
+}
+
+// NetworksToString returns networks as a comma separated list, as used by the from option.
+func NetworksToString(networks []*net.IPNet) string {
+	s := make([]string, len(networks))
+	for i, n := range networks {
+		s[i] = n.String()
+	}
+	return strings.Join(s, networkDelim)
+}
+
+// ContainsAddress returns true if one of the networks contains ip.
+func ContainsAddress(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IntersectNetworks returns the networks that are contained in both a and b. Since prefixes either nest or are
+// disjoint, the result is exact.
+func IntersectNetworks(a, b []*net.IPNet) []*net.IPNet {
+	ret := make([]*net.IPNet, 0, len(a))
+	for _, na := range a {
+		for _, nb := range b {
+			onesA, _ := na.Mask.Size()
+			onesB, _ := nb.Mask.Size()
+			switch {
+			case len(na.IP) != len(nb.IP):
+			case onesA >= onesB && nb.Contains(na.IP):
+				ret = append(ret, na)
+			case onesB > onesA && na.Contains(nb.IP):
+				ret = append(ret, nb)
+			}
+		}
+	}
+	return ret
+}
+
+// AddSourceOption returns an authorized-keys line (or principal) with a from option for networks prepended.
+func AddSourceOption(line string, networks []*net.IPNet) string {
+	if len(networks) == 0 {
+		return line
+	}
+	opt := conditionSource + "=\"" + NetworksToString(networks) + "\""
+	if q := trimRunesLeft([]rune(line), func(r rune) bool { return r == ' ' || r == '\t' }); len(q) > 0 && !isKey(q) {
+		if _, err := ParseKey(line); err == nil {
+			return opt + "," + string(q)
+		}
+	}
+	return opt + " " + line
+}
@@ -0,0 +1,69 @@
+package sshkey
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestConditions(t *testing.T) {
+	networks, err := ParseNetworks([]string{"10.0.0.0/8", "2001:db8::/32", "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("ParseNetworks: %s", err)
+	}
+	if s := NetworksToString(networks); s != "10.0.0.0/8,2001:db8::/32,192.168.1.1/32" {
+		t.Errorf("NetworksToString: %s", s)
+	}
+	s := Conditions{SourceNetworks: networks}.String()
+	if !strings.HasPrefix(s, ConditionsDelim) || strings.ContainsAny(s, ": ") {
+		t.Errorf("conditions not encoded for the validity field: %s", s)
+	}
+	validity, encoded := SplitConditions("20210101000000-20310101000000" + s)
+	if validity != "20210101000000-20310101000000" {
+		t.Errorf("SplitConditions: %s", validity)
+	}
+	conditions, err := ParseConditions(encoded)
+	if err != nil || NetworksToString(conditions.SourceNetworks) != NetworksToString(networks) {
+		t.Errorf("ParseConditions: %v %v", err, conditions.SourceNetworks)
+	}
+	if Conditions.String(Conditions{}) != "" {
+		t.Error("empty conditions must not be encoded")
+	}
+	for _, bad := range []string{"unknown=1", "from=10.0.0.1/8", "from=nowhere", "from=10.0.0.0/8&from=10.0.0.0/8"} {
+		if _, err := ParseConditions(bad); err == nil {
+			t.Errorf("ParseConditions(%q) must fail", bad)
+		}
+	}
+	if !ContainsAddress(networks, net.ParseIP("10.1.2.3")) || ContainsAddress(networks, net.ParseIP("11.1.2.3")) {
+		t.Error("ContainsAddress")
+	}
+}
+
+func TestIntersectNetworks(t *testing.T) {
+	a, _ := ParseNetworks([]string{"10.0.0.0/8", "192.168.0.0/16"})
+	b, _ := ParseNetworks([]string{"10.20.0.0/16", "172.16.0.0/12", "192.0.0.0/8", "2001:db8::/32"})
+	if s := NetworksToString(IntersectNetworks(a, b)); s != "10.20.0.0/16,192.168.0.0/16" {
+		t.Errorf("IntersectNetworks: %s", s)
+	}
+	if len(IntersectNetworks(a[:1], b[1:2])) != 0 {
+		t.Error("disjoint networks must not intersect")
+	}
+}
+
+func TestAddSourceOption(t *testing.T) {
+	key := "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBJcOEAu5+f9pPqRM6rZWbWUsh/uV8lWpXjYSwy1QrvtuyyJTYtVJkVxl+Kry0UC/SaqYayt9jnEXaBEZLXLeS2w="
+	networks, _ := ParseNetworks([]string{"10.0.0.0/8"})
+	td := map[string]string{
+		key:             `from="10.0.0.0/8" ` + key,
+		"no-pty " + key: `from="10.0.0.0/8",no-pty ` + key,
+		"admin":         `from="10.0.0.0/8" admin`,
+	}
+	for line, expect := range td {
+		if s := AddSourceOption(line, networks); s != expect {
+			t.Errorf("AddSourceOption(%q): %s", line, s)
+		}
+	}
+	if AddSourceOption(key, nil) != key {
+		t.Error("line without networks must not change")
+	}
+}
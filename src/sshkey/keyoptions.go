@@ -13,12 +13,21 @@ const (
 	sshKeyExpireFormatISO      = "2006-01-02 15:04:05"
 )
 
-// ExpireTimeToString returns the formatted expiry-time or an empty string if expiry is zero.
+// ExpireTimeToString returns the formatted expiry-time in UTC or an empty string if expiry is zero.
 func ExpireTimeToString(expireTime time.Time) string {
 	if expireTime.IsZero() {
 		return ""
 	}
-	return expireTime.Format(sshKeyExpireFormatTimeLong)
+	return expireTime.UTC().Format(sshKeyExpireFormatTimeLong)
+}
+
+// ValidityToString returns the formatted validity of an entry: the expiry-time, prefixed with the start time and "-"
+// if notBefore is not zero.
+func ValidityToString(notBefore, notAfter time.Time) string {
+	if notBefore.IsZero() {
+		return ExpireTimeToString(notAfter)
+	}
+	return notBefore.UTC().Format(sshKeyExpireFormatTimeLong) + "-" + ExpireTimeToString(notAfter)
 }
 
 func parseExpireTime(expireString string) (time.Time, error) {
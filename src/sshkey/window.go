@@ -0,0 +1,121 @@
+package sshkey
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	windowTimeFormat = "15:04"
+	minutesPerDay    = 24 * 60
+)
+
+var (
+	// ErrWindow is returned for access windows that cannot be parsed.
+	ErrWindow = errors.New("invalid access window")
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Window is a recurring period of time during which access is allowed, like "Mon-Fri 08:00-18:00 Europe/Berlin".
+// Days are a comma separated list of weekdays and ranges of weekdays, or "*" for every day. The end time may be
+// "24:00", and may be earlier than the start time for windows that end on the next day. The time zone defaults to UTC.
+type Window struct {
+	days       [7]bool
+	start, end int // Minutes of the day.
+	location   *time.Location
+	spec       string
+}
+
+// ParseWindow parses an access window.
+func ParseWindow(s string) (*Window, error) {
+	f := strings.Fields(s)
+	if len(f) < 2 || len(f) > 3 {
+		return nil, ErrWindow
+	}
+	w := &Window{location: time.UTC, spec: strings.Join(f, " ")}
+	if err := w.parseDays(f[0]); err != nil {
+		return nil, err
+	}
+	times := strings.Split(f[1], "-")
+	if len(times) != 2 {
+		return nil, ErrWindow
+	}
+	var err error
+	if w.start, err = parseMinutes(times[0]); err != nil || w.start == minutesPerDay {
+		return nil, ErrWindow
+	}
+	if w.end, err = parseMinutes(times[1]); err != nil || w.start == w.end {
+		return nil, ErrWindow
+	}
+	if len(f) == 3 {
+		if w.location, err = time.LoadLocation(f[2]); err != nil {
+			return nil, ErrWindow
+		}
+	}
+	return w, nil
+}
+
+func (w *Window) parseDays(s string) error {
+	if s == "*" {
+		for i := range w.days {
+			w.days[i] = true
+		}
+		return nil
+	}
+	for _, r := range strings.Split(s, ",") {
+		days := strings.Split(strings.ToLower(r), "-")
+		first, ok := weekdays[days[0]]
+		if !ok || len(days) > 2 {
+			return ErrWindow
+		}
+		last := first
+		if len(days) == 2 {
+			if last, ok = weekdays[days[1]]; !ok {
+				return ErrWindow
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func parseMinutes(s string) (int, error) {
+	if s == "24:00" {
+		return minutesPerDay, nil
+	}
+	t, err := time.Parse(windowTimeFormat, s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Contains returns true if t is within the window.
+func (w *Window) Contains(t time.Time) bool {
+	t = t.In(w.location)
+	day, minute := t.Weekday(), t.Hour()*60+t.Minute()
+	if w.start < w.end {
+		return w.days[day] && minute >= w.start && minute < w.end
+	}
+	return (w.days[day] && minute >= w.start) || (w.days[(day+6)%7] && minute < w.end)
+}
+
+// String returns the window as it was parsed.
+func (w *Window) String() string {
+	return w.spec
+}
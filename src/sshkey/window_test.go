@@ -0,0 +1,47 @@
+package sshkey
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindow(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no time zone data: %s", err)
+	}
+	// 2024-01-01 is a Monday.
+	td := []struct {
+		window string
+		time   time.Time
+		open   bool
+	}{
+		{"Mon-Fri 08:00-18:00 Europe/Berlin", time.Date(2024, 1, 1, 8, 0, 0, 0, berlin), true},
+		{"Mon-Fri 08:00-18:00 Europe/Berlin", time.Date(2024, 1, 1, 7, 0, 0, 0, time.UTC), true},
+		{"Mon-Fri 08:00-18:00 Europe/Berlin", time.Date(2024, 1, 1, 18, 0, 0, 0, berlin), false},
+		{"Mon-Fri 08:00-18:00 Europe/Berlin", time.Date(2024, 1, 6, 12, 0, 0, 0, berlin), false},
+		{"Mon-Fri 08:00-18:00", time.Date(2024, 1, 1, 8, 30, 0, 0, berlin), false},
+		{"Mon-Fri 08:00-18:00", time.Date(2024, 1, 1, 9, 30, 0, 0, berlin), true},
+		{"Sat,Sun 00:00-24:00", time.Date(2024, 1, 7, 23, 59, 0, 0, time.UTC), true},
+		{"Fri-Mon 10:00-11:00", time.Date(2024, 1, 3, 10, 30, 0, 0, time.UTC), false},
+		{"Fri-Mon 10:00-11:00", time.Date(2024, 1, 7, 10, 30, 0, 0, time.UTC), true},
+		{"Sun 22:00-06:00", time.Date(2024, 1, 1, 5, 0, 0, 0, time.UTC), true},
+		{"Sun 22:00-06:00", time.Date(2024, 1, 1, 22, 0, 0, 0, time.UTC), false},
+		{"* 22:00-06:00", time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC), true},
+	}
+	for _, d := range td {
+		w, err := ParseWindow(d.window)
+		if err != nil {
+			t.Errorf("ParseWindow(%q): %s", d.window, err)
+			continue
+		}
+		if w.Contains(d.time) != d.open {
+			t.Errorf("%q contains %s: %t", d.window, d.time, !d.open)
+		}
+	}
+	for _, bad := range []string{"", "Mon-Fri", "Mon-Fri 08:00", "Mo 08:00-18:00", "Mon 08:00-08:00", "Mon 24:00-01:00", "Mon 08:00-18:00 Nowhere/City", "Mon 8-18"} {
+		if _, err := ParseWindow(bad); err == nil {
+			t.Errorf("ParseWindow(%q) must fail", bad)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package stringduration
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Duration is a time.Duration that is encoded as a string in JSON, for use in configuration files.
+type Duration time.Duration
+
+// MarshalJSON encodes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON parses the duration from a string as accepted by Parse or time.ParseDuration.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	dur, err := Parse(s)
+	if err != nil {
+		if dur, err = time.ParseDuration(s); err != nil {
+			return err
+		}
+	}
+	*d = Duration(dur)
+	return nil
+}
+
+// Duration returns the value as time.Duration.
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
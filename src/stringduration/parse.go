@@ -13,6 +13,9 @@ func Parse(s string) (time.Duration, error) {
 	var err error
 	var symbol, lastSymbol byte
 	rem := []rune(s)
+	if len(rem) == 0 {
+		return 0, nil
+	}
 	lastSymbol = 255
 ParseLoop:
 	for {